@@ -1,17 +1,21 @@
 package main
 
 import (
-	_ "context"
+	"bufio"
+	"context"
 	"errors"
 	conf "go-diploma/server/config"
+	"go-diploma/server/control"
 	"go-diploma/server/logger"
 	serv "go-diploma/server/server"
 	"go.uber.org/zap"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -36,6 +40,22 @@ func main() {
 		return
 	}
 
+	if config.Command == `unlock` {
+		log.Info(`Command unlock received for login: ` + config.Login)
+		if !runAdminCommand(config, log, unlockLogin) {
+			log.Error(`do not unlock`)
+		}
+		return
+	}
+
+	if config.Command == `create-admin` {
+		log.Info(`Command create-admin received for login: ` + config.Login)
+		if !runAdminCommand(config, log, createAdmin) {
+			log.Error(`do not create admin`)
+		}
+		return
+	}
+
 	exit := make(chan os.Signal, 1)
 	signal.Notify(exit, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGABRT, syscall.SIGINT)
 	go func() {
@@ -90,19 +110,65 @@ func main() {
 	}
 }
 
+// gracefulShutdown
+// Остановка через управляющий интерфейс (CONTROL_ADDRESS), а не через публичный API.
 func gracefulShutdown(c conf.Config, l *zap.Logger) bool {
-	shutdownURL := `http://` + c.MartAddress + `/app/shutdown`
-	l.Info(`Shutdown by: ` + shutdownURL)
-	request, err := http.NewRequest(http.MethodPost, shutdownURL, nil)
-	if err != nil {
-		l.Error(err.Error())
-	}
-	response, err := http.DefaultClient.Do(request)
+	l.Info(`Shutdown by control interface: ` + c.Control.Address)
+	client := control.NewClient(c.Control.Address, c.Control.Token)
+	response, err := client.Do(context.Background(), http.MethodPost, `/shutdown`, ``)
 	if err != nil {
 		l.Error(err.Error())
+		return false
 	}
 	l.Info(`Status code: ` + strconv.Itoa(response.StatusCode))
 	err = response.Body.Close()
 
 	return err == nil && response.StatusCode == http.StatusOK
 }
+
+// runAdminCommand
+// Поднимает сервер без HTTP, накатывает миграции и выполняет команду.
+func runAdminCommand(c conf.Config, l *zap.Logger, command func(*serv.Server, conf.Config) error) bool {
+	if c.Login == `` {
+		l.Error(`login is required: -login=<login>`)
+		return false
+	}
+	var server serv.Server
+	err := server.New(c, l)
+	if err != nil {
+		l.Error(err.Error())
+		return false
+	}
+	defer server.DB.Close()
+	err = server.DB.PrepareDB()
+	if err != nil {
+		l.Error(err.Error())
+		return false
+	}
+	err = command(&server, c)
+	if err != nil {
+		l.Error(err.Error())
+		return false
+	}
+	l.Info(`Command done`)
+	return true
+}
+
+func unlockLogin(server *serv.Server, c conf.Config) error {
+	return server.UnlockLogin(context.Background(), c.Login)
+}
+
+// createAdmin
+// Пароль берётся из ADMIN_PASSWORD или первой строкой из stdin,
+// чтобы не светиться в списке процессов.
+func createAdmin(server *serv.Server, c conf.Config) error {
+	password := os.Getenv(`ADMIN_PASSWORD`)
+	if password == `` {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	return server.CreateAdmin(context.Background(), c.Login, password)
+}
@@ -0,0 +1,239 @@
+package passwordhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-diploma/internal/utils/hash/sha1hash"
+	"golang.org/x/crypto/argon2"
+	"strings"
+)
+
+var (
+	ErrEmptyPassword = errors.New(`empty input item`)
+	ErrUnknownFormat = errors.New(`unknown password hash format`)
+	ErrMalformedHash = errors.New(`malformed password hash`)
+	ErrInvalidParams = errors.New(`argon2id time, memory, threads and key length must be positive`)
+)
+
+// Hasher хэширует и проверяет пароли в одном конкретном формате.
+type Hasher interface {
+	// Hash возвращает закодированный хэш вместе с солью и параметрами.
+	Hash(password string) (string, error)
+	// Verify сравнивает пароль с хэшем за постоянное время.
+	Verify(password, encoded string) (bool, error)
+	// Recognize сообщает, записан ли хэш в формате этого хэшера.
+	Recognize(encoded string) bool
+	// NeedsRehash сообщает, что хэш записан с устаревшими параметрами.
+	NeedsRehash(encoded string) bool
+}
+
+/**
+ * Argon2id
+ */
+
+const argon2idPrefix = `$argon2id$`
+
+// Argon2id хранит хэши в формате PHC:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+func DefaultArgon2id() Argon2id {
+	return Argon2id{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 2,
+		KeyLen:  32,
+		SaltLen: 16,
+	}
+}
+
+// Validate нулевые время, память или число потоков argon2.IDKey не принимает (паника).
+func (a Argon2id) Validate() error {
+	if a.Time < 1 || a.Memory < 1 || a.Threads < 1 || a.KeyLen < 1 {
+		return ErrInvalidParams
+	}
+	return nil
+}
+
+func (a Argon2id) Hash(password string) (string, error) {
+	if len(password) == 0 {
+		return ``, ErrEmptyPassword
+	}
+	if err := a.Validate(); err != nil {
+		return ``, err
+	}
+	salt := make([]byte, a.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return ``, err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+
+	return fmt.Sprintf(
+		`%sv=%d$m=%d,t=%d,p=%d$%s$%s`,
+		argon2idPrefix, argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a Argon2id) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a Argon2id) Recognize(encoded string) bool {
+	return strings.HasPrefix(encoded, argon2idPrefix)
+}
+
+func (a Argon2id) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Time != a.Time ||
+		params.Memory != a.Memory ||
+		params.Threads != a.Threads ||
+		uint32(len(key)) != a.KeyLen ||
+		uint32(len(salt)) != a.SaltLen
+}
+
+func decodeArgon2id(encoded string) (Argon2id, []byte, []byte, error) {
+	var params Argon2id
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(encoded, `$`)
+	if len(parts) != 6 || parts[1] != `argon2id` {
+		return params, nil, nil, ErrUnknownFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], `v=%d`, &version); err != nil {
+		return params, nil, nil, fmt.Errorf(err.Error()+`: %w`, ErrMalformedHash)
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf(`unsupported argon2 version %d: %w`, version, ErrMalformedHash)
+	}
+	_, err := fmt.Sscanf(parts[3], `m=%d,t=%d,p=%d`, &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf(err.Error()+`: %w`, ErrMalformedHash)
+	}
+	if params.Time < 1 || params.Memory < 1 || params.Threads < 1 {
+		return params, nil, nil, fmt.Errorf(`%s: %w`, parts[3], ErrMalformedHash)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf(err.Error()+`: %w`, ErrMalformedHash)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrMalformedHash
+	}
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+/**
+ * LegacySHA1 - несолёные sha1 хэши, которые хранились раньше.
+ * Используется только для проверки, новые хэши в этом формате не создаются.
+ */
+
+type LegacySHA1 struct{}
+
+func (LegacySHA1) Hash(string) (string, error) {
+	return ``, errors.New(`legacy sha1 hashes must not be created`)
+}
+
+func (LegacySHA1) Verify(password, encoded string) (bool, error) {
+	if len(password) == 0 {
+		return false, nil
+	}
+	h, err := sha1hash.Hash(password)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(h), []byte(encoded)) == 1, nil
+}
+
+func (LegacySHA1) Recognize(encoded string) bool {
+	if len(encoded) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+func (LegacySHA1) NeedsRehash(string) bool {
+	return true
+}
+
+/**
+ * Passwords - точка входа для сервера: новые пароли хэшируются
+ * текущим хэшером, старые форматы только проверяются.
+ */
+
+type Passwords struct {
+	Current Hasher
+	Legacy  []Hasher
+	// dummy - хэш, с которым сравниваются пароли несуществующих пользователей,
+	// чтобы время ответа не выдавало наличие логина.
+	dummy string
+}
+
+func New(current Hasher) Passwords {
+	dummy, _ := current.Hash(`dummy password for missing users`)
+	return Passwords{
+		Current: current,
+		Legacy:  []Hasher{LegacySHA1{}},
+		dummy:   dummy,
+	}
+}
+
+// VerifyDummy тратит на проверку столько же времени, сколько Verify
+// для существующего пользователя, и всегда возвращает false.
+func (p Passwords) VerifyDummy(password string) bool {
+	_, _ = p.Current.Verify(password, p.dummy)
+	return false
+}
+
+func (p Passwords) Hash(password string) (string, error) {
+	return p.Current.Hash(password)
+}
+
+// Verify проверяет пароль и сообщает, нужно ли перезаписать хэш
+// текущим хэшером (старый формат или устаревшие параметры).
+func (p Passwords) Verify(password, encoded string) (ok bool, rehash bool, err error) {
+	if p.Current.Recognize(encoded) {
+		ok, err = p.Current.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, p.Current.NeedsRehash(encoded), nil
+	}
+	for _, h := range p.Legacy {
+		if !h.Recognize(encoded) {
+			continue
+		}
+		ok, err = h.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		return true, true, nil
+	}
+	return false, false, ErrUnknownFormat
+}
@@ -0,0 +1,140 @@
+package passwordhash
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func testArgon2id() Argon2id {
+	a := DefaultArgon2id()
+	a.Time = 1
+	a.Memory = 1024
+	return a
+}
+
+func TestArgon2id_Hash(t *testing.T) {
+	a := testArgon2id()
+
+	first, err := a.Hash(`password`)
+	require.NoError(t, err)
+	second, err := a.Hash(`password`)
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(first, `$argon2id$v=19$m=1024,t=1,p=2$`))
+	assert.NotEqual(t, first, second, `salt must differ between hashes`)
+
+	_, err = a.Hash(``)
+	assert.ErrorIs(t, err, ErrEmptyPassword)
+
+	for _, broken := range []func(*Argon2id){
+		func(a *Argon2id) { a.Time = 0 },
+		func(a *Argon2id) { a.Memory = 0 },
+		func(a *Argon2id) { a.Threads = 0 },
+		func(a *Argon2id) { a.KeyLen = 0 },
+	} {
+		b := testArgon2id()
+		broken(&b)
+		_, err = b.Hash(`password`)
+		assert.ErrorIs(t, err, ErrInvalidParams)
+	}
+}
+
+func TestPasswords_Verify(t *testing.T) {
+	p := New(testArgon2id())
+	current, err := p.Hash(`password`)
+	require.NoError(t, err)
+
+	stronger := testArgon2id()
+	stronger.Time = 2
+	outdated, err := stronger.Hash(`password`)
+	require.NoError(t, err)
+
+	type want struct {
+		ok     bool
+		rehash bool
+		err    error
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		encoded  string
+		want     want
+	}{
+		{
+			name:     `Test current hash`,
+			password: `password`,
+			encoded:  current,
+			want:     want{ok: true, rehash: false},
+		},
+		{
+			name:     `Test wrong password`,
+			password: `Password`,
+			encoded:  current,
+			want:     want{ok: false, rehash: false},
+		},
+		{
+			name:     `Test outdated params`,
+			password: `password`,
+			encoded:  outdated,
+			want:     want{ok: true, rehash: true},
+		},
+		{
+			name:     `Test legacy sha1 hash`,
+			password: `password`,
+			encoded:  `5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8`,
+			want:     want{ok: true, rehash: true},
+		},
+		{
+			name:     `Test legacy sha1 wrong password`,
+			password: `passw0rd`,
+			encoded:  `5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8`,
+			want:     want{ok: false, rehash: false},
+		},
+		{
+			name:     `Test unknown format`,
+			password: `password`,
+			encoded:  `plain`,
+			want:     want{ok: false, rehash: false, err: ErrUnknownFormat},
+		},
+		{
+			name:     `Test zero time`,
+			password: `password`,
+			encoded:  `$argon2id$v=19$m=1024,t=0,p=2$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5`,
+			want:     want{ok: false, rehash: false, err: ErrMalformedHash},
+		},
+		{
+			name:     `Test zero threads`,
+			password: `password`,
+			encoded:  `$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5`,
+			want:     want{ok: false, rehash: false, err: ErrMalformedHash},
+		},
+		{
+			name:     `Test zero memory`,
+			password: `password`,
+			encoded:  `$argon2id$v=19$m=0,t=1,p=2$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5`,
+			want:     want{ok: false, rehash: false, err: ErrMalformedHash},
+		},
+		{
+			name:     `Test malformed argon2id`,
+			password: `password`,
+			encoded:  `$argon2id$v=19$m=x$salt$key`,
+			want:     want{ok: false, rehash: false, err: ErrMalformedHash},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := p.Verify(tt.password, tt.encoded)
+			if tt.want.err != nil {
+				assert.ErrorIs(t, err, tt.want.err)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.want.ok, ok)
+			assert.Equal(t, tt.want.rehash, rehash)
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package loginpolicy
+
+import (
+	"fmt"
+	"go-diploma/internal/utils/passwordpolicy"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultPattern латиница в нижнем регистре, цифры и . _ @ - (не в начале).
+const DefaultPattern = `^[a-z0-9][a-z0-9._@-]*$`
+
+// Причины отказа, которые получает клиент.
+const (
+	ReasonTooShort = `too_short`
+	ReasonTooLong  = `too_long`
+	ReasonPattern  = `invalid_characters`
+)
+
+type Policy struct {
+	MinLength int
+	MaxLength int
+	Pattern   *regexp.Regexp
+}
+
+func New(minLength int, maxLength int, pattern string) (Policy, error) {
+	if pattern == `` {
+		pattern = DefaultPattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Policy{}, fmt.Errorf(`login pattern: %w`, err)
+	}
+	return Policy{MinLength: minLength, MaxLength: maxLength, Pattern: re}, nil
+}
+
+// Normalize
+// Логин хранится и ищется в одном виде: без пробелов по краям и в нижнем регистре.
+// Регистр понижается так же, как lower() в базе, на которой держится уникальность.
+func Normalize(login string) string {
+	return strings.ToLower(strings.TrimSpace(login))
+}
+
+// Validate
+// Проверяет уже нормализованный логин. Нарушения в формате ответа политики паролей.
+func (p Policy) Validate(field string, login string) []passwordpolicy.Violation {
+	var violations []passwordpolicy.Violation
+	add := func(reason string, message string) {
+		violations = append(violations, passwordpolicy.Violation{Field: field, Reason: reason, Message: message})
+	}
+
+	length := utf8.RuneCountInString(login)
+	if length < p.MinLength {
+		add(ReasonTooShort, fmt.Sprintf(`must be at least %d characters`, p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add(ReasonTooLong, fmt.Sprintf(`must be at most %d characters`, p.MaxLength))
+	}
+	if login != `` && p.Pattern != nil && !p.Pattern.MatchString(login) {
+		add(ReasonPattern, `contains characters that are not allowed`)
+	}
+	return violations
+}
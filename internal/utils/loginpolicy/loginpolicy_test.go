@@ -0,0 +1,67 @@
+package loginpolicy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name  string
+		login string
+		want  string
+	}{
+		{name: `Test already normal`, login: `alice`, want: `alice`},
+		{name: `Test upper case`, login: `Alice`, want: `alice`},
+		{name: `Test spaces`, login: "  alice \t", want: `alice`},
+		{name: `Test unicode`, login: `ÁLICE`, want: `álice`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Normalize(tt.login))
+		})
+	}
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	p, err := New(3, 10, ``)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		login   string
+		reasons []string
+	}{
+		{name: `Test valid login`, login: `alice.b-1`, reasons: nil},
+		{name: `Test email like login`, login: `a@b.ru`, reasons: nil},
+		{name: `Test too short`, login: `al`, reasons: []string{ReasonTooShort}},
+		{name: `Test too long`, login: `alice-in-wonderland`, reasons: []string{ReasonTooLong}},
+		{name: `Test empty`, login: ``, reasons: []string{ReasonTooShort}},
+		{name: `Test inner space`, login: `ali ce`, reasons: []string{ReasonPattern}},
+		{name: `Test leading dot`, login: `.alice`, reasons: []string{ReasonPattern}},
+		{name: `Test not latin`, login: `алиса`, reasons: []string{ReasonPattern}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reasons []string
+			for _, v := range p.Validate(`login`, tt.login) {
+				assert.Equal(t, `login`, v.Field)
+				reasons = append(reasons, v.Reason)
+			}
+			assert.Equal(t, tt.reasons, reasons)
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	p, err := New(1, 0, `^[a-z]+$`)
+	require.NoError(t, err)
+	assert.Empty(t, p.Validate(`login`, `alice`))
+	assert.NotEmpty(t, p.Validate(`login`, `alice1`))
+
+	_, err = New(1, 0, `[`)
+	assert.Error(t, err)
+}
@@ -0,0 +1,151 @@
+package money
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgtype"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Scale копеек в рубле (баллов - в балле). В базе суммы хранятся как numeric(18,2).
+const Scale = 100
+
+var (
+	ErrFormat   = errors.New(`invalid money amount`)
+	ErrOverflow = errors.New(`money amount is out of range`)
+	ErrNaN      = errors.New(`money amount is NaN`)
+)
+
+// Amount сумма в копейках. Сложение и сравнение точные, в JSON и в базе -
+// десятичное число с двумя знаками после точки.
+type Amount int64
+
+var (
+	// decimal только десятичная запись: big.Rat.SetString понимает и "1/3", и "0x10".
+	// Порядок не длиннее трёх цифр, чтобы "1e999999999" не считался минутами
+	decimal  = regexp.MustCompile(`^-?(\d+\.?\d*|\.\d+)([eE][+-]?\d{1,3})?$`)
+	bigScale = big.NewInt(Scale)
+	maxInt64 = big.NewInt(math.MaxInt64)
+	minInt64 = big.NewInt(math.MinInt64)
+)
+
+// Parse
+// Десятичная запись "12.34", "12", "1e3". Больше двух знаков после точки
+// округляется до копейки, половина - от нуля: так считает round() в базе.
+func Parse(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	if !decimal.MatchString(s) {
+		return 0, fmt.Errorf(s+`: %w`, ErrFormat)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf(s+`: %w`, ErrFormat)
+	}
+	return fromRat(r)
+}
+
+func fromRat(r *big.Rat) (Amount, error) {
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(bigScale))
+	quo, rem := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	// |rem| * 2 >= denom - округляем от нуля
+	if rem.Sign() != 0 && new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(scaled.Denom()) >= 0 {
+		quo.Add(quo, big.NewInt(int64(rem.Sign())))
+	}
+	if quo.Cmp(maxInt64) > 0 || quo.Cmp(minInt64) < 0 {
+		return 0, ErrOverflow
+	}
+	return Amount(quo.Int64()), nil
+}
+
+// String без лишних нулей: "12", "12.3", "12.34".
+func (a Amount) String() string {
+	sign := ``
+	v := uint64(a)
+	if a < 0 {
+		sign = `-`
+		v = uint64(-a)
+	}
+	whole := strconv.FormatUint(v/Scale, 10)
+	cents := v % Scale
+	switch {
+	case cents == 0:
+		return sign + whole
+	case cents%10 == 0:
+		return sign + whole + `.` + strconv.FormatUint(cents/10, 10)
+	default:
+		return sign + whole + `.` + fmt.Sprintf(`%02d`, cents)
+	}
+}
+
+// MarshalJSON число, как в спецификации: 500.5, 42.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON принимает число или строку с числом.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte(`null`)) {
+		return nil
+	}
+	if len(data) >= 2 && data[0] == '"' && data[len(data)-1] == '"' {
+		data = data[1 : len(data)-1]
+	}
+	parsed, err := Parse(string(data))
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// UnmarshalText для значений из переменных окружения.
+func (a *Amount) UnmarshalText(text []byte) error {
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// ScanNumeric чтение numeric из базы, NULL - ноль.
+func (a *Amount) ScanNumeric(v pgtype.Numeric) error {
+	if !v.Valid {
+		*a = 0
+		return nil
+	}
+	if v.NaN || v.InfinityModifier != pgtype.Finite {
+		return ErrNaN
+	}
+	r := new(big.Rat).SetInt(v.Int)
+	exp := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(absInt32(v.Exp))), nil)
+	if v.Exp >= 0 {
+		r.Mul(r, new(big.Rat).SetInt(exp))
+	} else {
+		r.Quo(r, new(big.Rat).SetInt(exp))
+	}
+	parsed, err := fromRat(r)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// NumericValue запись в numeric без потерь.
+func (a Amount) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: big.NewInt(int64(a)), Exp: -2, Valid: true}, nil
+}
+
+func absInt32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,184 @@
+package money
+
+import (
+	"encoding/json"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"math/rand"
+	"testing"
+	"testing/quick"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  Amount
+		err   error
+	}{
+		{name: `Test integer`, value: `42`, want: 4200},
+		{name: `Test one digit`, value: `500.5`, want: 50050},
+		{name: `Test two digits`, value: `751.99`, want: 75199},
+		{name: `Test exponent`, value: `1e3`, want: 100000},
+		{name: `Test negative`, value: `-0.05`, want: -5},
+		{name: `Test round half up`, value: `0.125`, want: 13},
+		{name: `Test round half away from zero`, value: `-0.125`, want: -13},
+		{name: `Test round down`, value: `0.124`, want: 12},
+		{name: `Test garbage`, value: `ten`, err: ErrFormat},
+		{name: `Test fraction`, value: `1/3`, err: ErrFormat},
+		{name: `Test hex`, value: `0x10`, err: ErrFormat},
+		{name: `Test binary`, value: `0b1`, err: ErrFormat},
+		{name: `Test underscores`, value: `1_000`, err: ErrFormat},
+		{name: `Test infinity`, value: `Inf`, err: ErrFormat},
+		{name: `Test huge exponent`, value: `1e999999999`, err: ErrFormat},
+		{name: `Test empty`, value: ``, err: ErrFormat},
+		{name: `Test overflow`, value: `1e20`, err: ErrOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.value)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAmount_JSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount Amount
+		json   string
+	}{
+		{name: `Test integer`, amount: 4200, json: `42`},
+		{name: `Test one digit`, amount: 50050, json: `500.5`},
+		{name: `Test two digits`, amount: 75199, json: `751.99`},
+		{name: `Test cents`, amount: 5, json: `0.05`},
+		{name: `Test negative`, amount: -150, json: `-1.5`},
+		{name: `Test zero`, amount: 0, json: `0`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marshaled, err := json.Marshal(tt.amount)
+			require.NoError(t, err)
+			assert.Equal(t, tt.json, string(marshaled))
+
+			var parsed Amount
+			require.NoError(t, json.Unmarshal(marshaled, &parsed))
+			assert.Equal(t, tt.amount, parsed)
+		})
+	}
+
+	var body struct {
+		Sum Amount `json:"sum"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"sum": "751.99"}`), &body))
+	assert.Equal(t, Amount(75199), body.Sum)
+	assert.Error(t, json.Unmarshal([]byte(`{"sum": true}`), &body))
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"sum": "0x10"}`), &body), ErrFormat)
+}
+
+func TestAmount_Numeric(t *testing.T) {
+	tests := []struct {
+		name    string
+		numeric pgtype.Numeric
+		want    Amount
+	}{
+		{name: `Test scale 2`, numeric: pgtype.Numeric{Int: big.NewInt(75199), Exp: -2, Valid: true}, want: 75199},
+		{name: `Test scale 0`, numeric: pgtype.Numeric{Int: big.NewInt(42), Exp: 0, Valid: true}, want: 4200},
+		{name: `Test positive exponent`, numeric: pgtype.Numeric{Int: big.NewInt(5), Exp: 2, Valid: true}, want: 50000},
+		{name: `Test sum with more digits`, numeric: pgtype.Numeric{Int: big.NewInt(12345), Exp: -4, Valid: true}, want: 123},
+		{name: `Test null`, numeric: pgtype.Numeric{}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Amount
+			require.NoError(t, got.ScanNumeric(tt.numeric))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	var a Amount
+	assert.ErrorIs(t, a.ScanNumeric(pgtype.Numeric{NaN: true, Valid: true}), ErrNaN)
+}
+
+// Круговые преобразования не теряют ни копейки.
+func TestAmount_RoundTripProperty(t *testing.T) {
+	property := func(v int64) bool {
+		a := Amount(v % 1e15)
+
+		parsed, err := Parse(a.String())
+		if err != nil || parsed != a {
+			return false
+		}
+		numeric, err := a.NumericValue()
+		if err != nil {
+			return false
+		}
+		var scanned Amount
+		return scanned.ScanNumeric(numeric) == nil && scanned == a
+	}
+	require.NoError(t, quick.Check(property, &quick.Config{MaxCount: 5000}))
+}
+
+// Проекция, которая меняется на месте после каждой операции (как accruals),
+// после любого числа операций совпадает с итогами, посчитанными заново по журналу.
+func TestAmount_LedgerReconcilesProperty(t *testing.T) {
+	type entry struct {
+		amount     Amount
+		withdrawal bool
+	}
+	property := func(seed int64) bool {
+		rnd := rand.New(rand.NewSource(seed))
+		var journal []entry
+		var balance, withdrawn Amount
+
+		for i := 0; i < 1000; i++ {
+			// случайная сумма до 10 000 с копейками, через текст - как из JSON
+			amount, err := Parse(big.NewRat(rnd.Int63n(1_000_000)+1, Scale).FloatString(2))
+			if err != nil {
+				return false
+			}
+			switch rnd.Intn(4) {
+			case 0, 1: // начисление
+				journal = append(journal, entry{amount: amount})
+				balance += amount
+			case 2: // списание, если хватает
+				if amount > balance {
+					continue
+				}
+				journal = append(journal, entry{amount: -amount, withdrawal: true})
+				balance -= amount
+				withdrawn += amount
+			case 3: // отмена случайной записи
+				if len(journal) == 0 {
+					continue
+				}
+				reversed := journal[rnd.Intn(len(journal))]
+				journal = append(journal, entry{amount: -reversed.amount, withdrawal: reversed.withdrawal})
+				balance -= reversed.amount
+				if reversed.withdrawal {
+					withdrawn += reversed.amount
+				}
+			}
+		}
+
+		var ledgerBalance, ledgerWithdrawn Amount
+		for _, e := range journal {
+			ledgerBalance += e.amount
+			if e.withdrawal {
+				ledgerWithdrawn -= e.amount
+			}
+		}
+		return ledgerBalance == balance && ledgerWithdrawn == withdrawn
+	}
+	require.NoError(t, quick.Check(property, &quick.Config{MaxCount: 200}))
+}
@@ -0,0 +1,143 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Классы символов, которые можно потребовать в пароле.
+const (
+	ClassLower  = `lower`
+	ClassUpper  = `upper`
+	ClassDigit  = `digit`
+	ClassSymbol = `symbol`
+)
+
+// Причины отказа, которые получает клиент.
+const (
+	ReasonTooShort     = `too_short`
+	ReasonTooLong      = `too_long`
+	ReasonMissingClass = `missing_`
+	ReasonCommon       = `common_password`
+	ReasonSameAsLogin  = `same_as_login`
+)
+
+//go:embed common_passwords.txt
+var commonPasswords string
+
+// Violation нарушение политики для конкретного поля запроса.
+type Violation struct {
+	Field   string `json:"field"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+type Policy struct {
+	MinLength int
+	MaxLength int
+	Require   []string
+	denylist  map[string]struct{}
+}
+
+// New собирает политику со встроенным списком распространённых паролей,
+// к которому добавляется локальный файл denylistFile (по паролю на строку).
+func New(minLength int, maxLength int, require []string, denylistFile string) (Policy, error) {
+	p := Policy{
+		MinLength: minLength,
+		MaxLength: maxLength,
+		denylist:  make(map[string]struct{}),
+	}
+	for _, class := range require {
+		class = strings.ToLower(strings.TrimSpace(class))
+		switch class {
+		case ``:
+			continue
+		case ClassLower, ClassUpper, ClassDigit, ClassSymbol:
+			p.Require = append(p.Require, class)
+		default:
+			return Policy{}, fmt.Errorf(`unknown password character class: %s`, class)
+		}
+	}
+
+	_ = p.addDenylist(strings.NewReader(commonPasswords))
+	if denylistFile != `` {
+		file, err := os.Open(denylistFile)
+		if err != nil {
+			return Policy{}, err
+		}
+		defer file.Close()
+		if err = p.addDenylist(file); err != nil {
+			return Policy{}, err
+		}
+	}
+	return p, nil
+}
+
+func (p *Policy) addDenylist(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		p.denylist[strings.ToLower(line)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+// Validate
+// Возвращает все нарушения сразу, чтобы клиент мог показать их вместе.
+func (p Policy) Validate(field string, password string, login string) []Violation {
+	var violations []Violation
+	add := func(reason string, message string) {
+		violations = append(violations, Violation{Field: field, Reason: reason, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		add(ReasonTooShort, fmt.Sprintf(`must be at least %d characters`, p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add(ReasonTooLong, fmt.Sprintf(`must be at most %d characters`, p.MaxLength))
+	}
+
+	present := classes(password)
+	for _, class := range p.Require {
+		if !present[class] {
+			add(ReasonMissingClass+class, fmt.Sprintf(`must contain a %s character`, class))
+		}
+	}
+
+	lowered := strings.ToLower(password)
+	if _, ok := p.denylist[lowered]; ok {
+		add(ReasonCommon, `is too common`)
+	}
+	if login != `` && lowered == strings.ToLower(login) {
+		add(ReasonSameAsLogin, `must differ from login`)
+	}
+
+	return violations
+}
+
+func classes(password string) map[string]bool {
+	present := make(map[string]bool, 4)
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			present[ClassLower] = true
+		case unicode.IsUpper(r):
+			present[ClassUpper] = true
+		case unicode.IsDigit(r):
+			present[ClassDigit] = true
+		default:
+			present[ClassSymbol] = true
+		}
+	}
+	return present
+}
@@ -0,0 +1,55 @@
+package passwordpolicy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func reasons(violations []Violation) []string {
+	result := make([]string, 0, len(violations))
+	for _, v := range violations {
+		result = append(result, v.Reason)
+	}
+	return result
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	denylist := filepath.Join(t.TempDir(), `denylist.txt`)
+	require.NoError(t, os.WriteFile(denylist, []byte("# local\nCorrectHorse1!\n"), 0600))
+
+	p, err := New(8, 16, []string{`lower`, `upper`, `digit`}, denylist)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		password string
+		login    string
+		want     []string
+	}{
+		{name: `Test valid password`, password: `Sturdy-Gopher42`, login: `user`, want: []string{}},
+		{name: `Test too short`, password: `Ab1`, want: []string{ReasonTooShort}},
+		{name: `Test too long`, password: `Abcdefghijklmnop1`, want: []string{ReasonTooLong}},
+		{name: `Test missing classes`, password: `lowercaseonly`, want: []string{`missing_upper`, `missing_digit`}},
+		{name: `Test common password`, password: `Password1`, want: []string{ReasonCommon}},
+		{name: `Test local denylist`, password: `correcthorse1!`, want: []string{`missing_upper`, ReasonCommon}},
+		{name: `Test same as login`, password: `Gopher2024`, login: `gopher2024`, want: []string{ReasonSameAsLogin}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := p.Validate(`password`, tt.password, tt.login)
+			assert.Equal(t, tt.want, reasons(violations))
+			for _, v := range violations {
+				assert.Equal(t, `password`, v.Field)
+			}
+		})
+	}
+}
+
+func TestNew_UnknownClass(t *testing.T) {
+	_, err := New(8, 0, []string{`emoji`}, ``)
+	assert.Error(t, err)
+}
@@ -0,0 +1,125 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Параметры по умолчанию, которые понимают все приложения-аутентификаторы.
+const (
+	DefaultDigits = 6
+	DefaultPeriod = 30 * time.Second
+	secretSize    = 20
+)
+
+var ErrMalformedSecret = errors.New(`malformed totp secret`)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP генератор одноразовых кодов по RFC 6238 (HMAC-SHA1).
+// Skew - сколько соседних интервалов принимается из-за расхождения часов.
+type TOTP struct {
+	Digits int
+	Period time.Duration
+	Skew   int
+}
+
+func New(skew int) TOTP {
+	return TOTP{Digits: DefaultDigits, Period: DefaultPeriod, Skew: skew}
+}
+
+// GenerateSecret случайный секрет в base32, как его вводят в приложение.
+func GenerateSecret() (string, error) {
+	raw := make([]byte, secretSize)
+	if _, err := rand.Read(raw); err != nil {
+		return ``, err
+	}
+	return encoding.EncodeToString(raw), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	raw, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, `=`)))
+	if err != nil || len(raw) == 0 {
+		return nil, ErrMalformedSecret
+	}
+	return raw, nil
+}
+
+// Step номер интервала для момента t.
+func (o TOTP) Step(t time.Time) int64 {
+	return t.Unix() / int64(o.Period/time.Second)
+}
+
+// Code код для интервала step (HOTP из RFC 4226 со счётчиком step).
+func (o TOTP) Code(secret string, step int64) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return ``, err
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < o.Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf(`%0*d`, o.Digits, value%mod), nil
+}
+
+// Validate
+// Ищет интервал в пределах Skew, для которого код совпадает, и возвращает его.
+// Интервал нужен вызывающему, чтобы не принять тот же код повторно.
+func (o TOTP) Validate(secret string, code string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != o.Digits {
+		return 0, false
+	}
+	if _, err := strconv.Atoi(code); err != nil {
+		return 0, false
+	}
+
+	current := o.Step(t)
+	for delta := -o.Skew; delta <= o.Skew; delta++ {
+		expected, err := o.Code(secret, current+int64(delta))
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return current + int64(delta), true
+		}
+	}
+	return 0, false
+}
+
+// ProvisioningURI ссылка otpauth:// для QR кода.
+func (o TOTP) ProvisioningURI(issuer string, account string, secret string) string {
+	params := url.Values{}
+	params.Set(`secret`, secret)
+	params.Set(`issuer`, issuer)
+	params.Set(`algorithm`, `SHA1`)
+	params.Set(`digits`, strconv.Itoa(o.Digits))
+	params.Set(`period`, strconv.Itoa(int(o.Period/time.Second)))
+
+	u := url.URL{
+		Scheme:   `otpauth`,
+		Host:     `totp`,
+		Path:     `/` + issuer + `:` + account,
+		RawQuery: params.Encode(),
+	}
+	return u.String()
+}
@@ -0,0 +1,92 @@
+package totp
+
+import (
+	"encoding/base32"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// секрет из приложения B RFC 6238 для SHA1
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte(`12345678901234567890`))
+
+func TestTOTP_Code(t *testing.T) {
+	o := TOTP{Digits: 8, Period: 30 * time.Second}
+
+	tests := []struct {
+		name string
+		unix int64
+		want string
+	}{
+		{name: `Test RFC 6238 vector 59`, unix: 59, want: `94287082`},
+		{name: `Test RFC 6238 vector 1111111109`, unix: 1111111109, want: `07081804`},
+		{name: `Test RFC 6238 vector 1111111111`, unix: 1111111111, want: `14050471`},
+		{name: `Test RFC 6238 vector 1234567890`, unix: 1234567890, want: `89005924`},
+		{name: `Test RFC 6238 vector 2000000000`, unix: 2000000000, want: `69279037`},
+		{name: `Test RFC 6238 vector 20000000000`, unix: 20000000000, want: `65353130`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := o.Code(rfcSecret, o.Step(time.Unix(tt.unix, 0)))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, code)
+		})
+	}
+}
+
+func TestTOTP_Validate(t *testing.T) {
+	o := New(1)
+	secret, err := GenerateSecret()
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	current, err := o.Code(secret, o.Step(now))
+	require.NoError(t, err)
+	previous, err := o.Code(secret, o.Step(now)-1)
+	require.NoError(t, err)
+	stale, err := o.Code(secret, o.Step(now)-2)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+		step int64
+	}{
+		{name: `Test current code`, code: current, ok: true, step: o.Step(now)},
+		{name: `Test previous code within skew`, code: previous, ok: true, step: o.Step(now) - 1},
+		{name: `Test stale code`, code: stale, ok: false},
+		{name: `Test wrong length`, code: `12345`, ok: false},
+		{name: `Test not digits`, code: `abcdef`, ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := o.Validate(secret, tt.code, now)
+			assert.Equal(t, tt.ok, ok)
+			if tt.ok {
+				assert.Equal(t, tt.step, step)
+			}
+		})
+	}
+
+	_, ok := o.Validate(`not base32!`, current, now)
+	assert.False(t, ok)
+}
+
+func TestTOTP_ProvisioningURI(t *testing.T) {
+	o := New(1)
+	uri := o.ProvisioningURI(`Gophermart`, `alice`, `JBSWY3DPEHPK3PXP`)
+
+	parsed, err := url.Parse(uri)
+	require.NoError(t, err)
+	assert.Equal(t, `otpauth`, parsed.Scheme)
+	assert.Equal(t, `totp`, parsed.Host)
+	assert.Equal(t, `/Gophermart:alice`, parsed.Path)
+	assert.Equal(t, `JBSWY3DPEHPK3PXP`, parsed.Query().Get(`secret`))
+	assert.Equal(t, `Gophermart`, parsed.Query().Get(`issuer`))
+	assert.Equal(t, `6`, parsed.Query().Get(`digits`))
+	assert.Equal(t, `30`, parsed.Query().Get(`period`))
+}
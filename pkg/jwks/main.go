@@ -0,0 +1,93 @@
+// Package jwks публикует и потребляет открытые ключи Гофермарта в формате JWK Set (RFC 7517).
+// Сервисы-соседи проверяют токены пользователей через Verifier, не зная секретов подписи.
+package jwks
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	ErrUnsupportedKey = errors.New(`unsupported key type`)
+	ErrMalformedKey   = errors.New(`malformed jwk`)
+)
+
+// Set JWK Set, как он отдаётся по /.well-known/jwks.json.
+type Set struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK открытый ключ. Поддерживаются RSA (RS256) и OKP/Ed25519 (EdDSA).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// OKP
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// FromPublicKey кодирует открытый ключ в JWK.
+func FromPublicKey(kid string, alg string, key crypto.PublicKey) (JWK, error) {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			KeyType:   `RSA`,
+			KeyID:     kid,
+			Use:       `sig`,
+			Algorithm: alg,
+			N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{
+			KeyType:   `OKP`,
+			KeyID:     kid,
+			Use:       `sig`,
+			Algorithm: alg,
+			Curve:     `Ed25519`,
+			X:         base64.RawURLEncoding.EncodeToString(pub),
+		}, nil
+	default:
+		return JWK{}, fmt.Errorf(`%T: %w`, key, ErrUnsupportedKey)
+	}
+}
+
+// PublicKey восстанавливает открытый ключ из JWK.
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case `RSA`:
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf(err.Error()+`: %w`, ErrMalformedKey)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ErrMalformedKey
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case `OKP`:
+		if k.Curve != `Ed25519` {
+			return nil, fmt.Errorf(`curve %s: %w`, k.Curve, ErrUnsupportedKey)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, ErrMalformedKey
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf(`kty %s: %w`, k.KeyType, ErrUnsupportedKey)
+	}
+}
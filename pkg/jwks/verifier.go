@@ -0,0 +1,181 @@
+package jwks
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/sync/singleflight"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownKey    = errors.New(`unknown key id`)
+	ErrInvalidClaims = errors.New(`invalid token claims`)
+)
+
+// Claims утверждения токена пользователя Гофермарта.
+type Claims struct {
+	jwt.RegisteredClaims
+	UserID    int
+	SessionID int    `json:"sid,omitempty"`
+	Role      string `json:"role,omitempty"`
+}
+
+// Verifier проверяет токены по ключам, опубликованным на JWKS ручке.
+// Ключи кешируются на RefreshInterval; незнакомый kid вызывает внеплановое
+// обновление, но не чаще MinRefreshInterval. Неудачная загрузка тоже выдерживает
+// MinRefreshInterval, а параллельные запросы ждут одну общую загрузку: недоступная
+// ручка не добавляет задержку к каждой проверке.
+type Verifier struct {
+	URL                string
+	Issuer             string
+	Audience           string
+	Client             *http.Client
+	RefreshInterval    time.Duration
+	MinRefreshInterval time.Duration
+
+	mu          sync.RWMutex
+	keys        map[string]cachedKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	refreshing  singleflight.Group
+}
+
+type cachedKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+func NewVerifier(url string, issuer string, audience string) *Verifier {
+	return &Verifier{
+		URL:                url,
+		Issuer:             issuer,
+		Audience:           audience,
+		Client:             &http.Client{Timeout: 5 * time.Second},
+		RefreshInterval:    10 * time.Minute,
+		MinRefreshInterval: 30 * time.Second,
+	}
+}
+
+// Verify проверяет подпись, срок действия, iss, aud и iat токена.
+func (v *Verifier) Verify(ctx context.Context, tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header[`kid`].(string)
+		key, err := v.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.alg != `` && key.alg != token.Method.Alg() {
+			return nil, fmt.Errorf(`unexpected signing method: %v`, token.Header[`alg`])
+		}
+		return key.key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, ErrInvalidClaims
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == nil ||
+		!claims.VerifyIssuedAt(now, true) ||
+		!claims.VerifyIssuer(v.Issuer, true) ||
+		!claims.VerifyAudience(v.Audience, true) {
+		return nil, ErrInvalidClaims
+	}
+	return claims, nil
+}
+
+func (v *Verifier) key(ctx context.Context, kid string) (cachedKey, error) {
+	v.mu.RLock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetchedAt) > v.RefreshInterval
+	recent := time.Since(v.attemptedAt) < v.MinRefreshInterval
+	v.mu.RUnlock()
+
+	if ok && (!stale || recent) {
+		return key, nil
+	}
+	if !ok && recent {
+		return cachedKey{}, fmt.Errorf(`kid "%s": %w`, kid, ErrUnknownKey)
+	}
+
+	if err := v.refresh(ctx); err != nil {
+		// при недоступной ручке продолжаем работать на закешированных ключах
+		if ok {
+			return key, nil
+		}
+		return cachedKey{}, err
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	key, ok = v.keys[kid]
+	if !ok {
+		return cachedKey{}, fmt.Errorf(`kid "%s": %w`, kid, ErrUnknownKey)
+	}
+	return key, nil
+}
+
+// refresh одна загрузка на всех, кто её ждёт. Загрузка не прерывается, если
+// отменён запрос, который её начал: её результат нужен остальным.
+func (v *Verifier) refresh(ctx context.Context) error {
+	done := v.refreshing.DoChan(`keys`, func() (interface{}, error) {
+		return nil, v.Refresh(context.Background())
+	})
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case result := <-done:
+		return result.Err
+	}
+}
+
+// Refresh загружает актуальный набор ключей.
+func (v *Verifier) Refresh(ctx context.Context) error {
+	v.mu.Lock()
+	v.attemptedAt = time.Now()
+	v.mu.Unlock()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, v.URL, nil)
+	if err != nil {
+		return err
+	}
+	response, err := v.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New(`unexpected response: ` + strconv.Itoa(response.StatusCode))
+	}
+
+	var set Set
+	if err = json.NewDecoder(response.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]cachedKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			// незнакомые типы ключей пропускаем, остальные остаются рабочими
+			continue
+		}
+		keys[jwk.KeyID] = cachedKey{alg: jwk.Algorithm, key: pub}
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	v.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,143 @@
+package jwks_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-diploma/pkg/jwks"
+	"go-diploma/server/config"
+	"go-diploma/server/cookie"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVerifier_Verify(t *testing.T) {
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edKey, err := cookie.NewAsymmetricKey(`ed`, edPrivate)
+	require.NoError(t, err)
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaKey, err := cookie.NewAsymmetricKey(`rsa`, rsaPrivate)
+	require.NoError(t, err)
+
+	tokens, err := cookie.NewTokens(config.JWTCfg{
+		Keys:     `hs:hs-secret-hs-secret-hs-secret-hs-secret`,
+		Issuer:   `gophermart`,
+		Audience: `gophermart`,
+		TTL:      time.Hour,
+	})
+	require.NoError(t, err)
+	tokens.Keys[edKey.ID] = edKey
+	tokens.Keys[rsaKey.ID] = rsaKey
+
+	requests := 0
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_ = json.NewEncoder(w).Encode(tokens.PublicKeys())
+	}))
+	defer jwksServer.Close()
+
+	verifier := jwks.NewVerifier(jwksServer.URL, `gophermart`, `gophermart`)
+
+	tests := []struct {
+		name    string
+		kid     string
+		wantErr bool
+	}{
+		{name: `Test EdDSA token`, kid: `ed`},
+		{name: `Test RS256 token`, kid: `rsa`},
+		{name: `Test HMAC token is not verifiable outside`, kid: `hs`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens.ActiveKID = tt.kid
+			issued, err := tokens.BuildJWTString(5, 6, cookie.RoleUser)
+			require.NoError(t, err)
+
+			claims, err := verifier.Verify(context.Background(), issued)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, 5, claims.UserID)
+			assert.Equal(t, 6, claims.SessionID)
+		})
+	}
+
+	assert.Equal(t, 1, requests, `keys must be served from cache`)
+
+	other := jwks.NewVerifier(jwksServer.URL, `gophermart`, `other-service`)
+	tokens.ActiveKID = `ed`
+	issued, err := tokens.BuildJWTString(5, 6, cookie.RoleUser)
+	require.NoError(t, err)
+	_, err = other.Verify(context.Background(), issued)
+	assert.ErrorIs(t, err, jwks.ErrInvalidClaims)
+}
+
+func TestJWK_PublicKey(t *testing.T) {
+	_, err := jwks.JWK{KeyType: `EC`}.PublicKey()
+	assert.ErrorIs(t, err, jwks.ErrUnsupportedKey)
+
+	_, err = jwks.JWK{KeyType: `OKP`, Curve: `Ed25519`, X: `short`}.PublicKey()
+	assert.ErrorIs(t, err, jwks.ErrMalformedKey)
+}
+
+func TestVerifier_RefreshBackoff(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer jwksServer.Close()
+
+	tokens, err := cookie.NewTokens(config.JWTCfg{Issuer: `gophermart`, Audience: `gophermart`, TTL: time.Hour})
+	require.NoError(t, err)
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edKey, err := cookie.NewAsymmetricKey(`ed`, edPrivate)
+	require.NoError(t, err)
+	tokens.Keys[edKey.ID] = edKey
+	tokens.ActiveKID = edKey.ID
+	issued, err := tokens.BuildJWTString(5, 6, cookie.RoleUser)
+	require.NoError(t, err)
+
+	verifier := jwks.NewVerifier(jwksServer.URL, `gophermart`, `gophermart`)
+
+	// параллельные проверки ждут одну загрузку
+	const checks = 10
+	errs := make(chan error, checks)
+	var wg sync.WaitGroup
+	for i := 0; i < checks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := verifier.Verify(context.Background(), issued)
+			errs <- err
+		}()
+	}
+	require.Eventually(t, func() bool { return requests.Load() == 1 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Error(t, err)
+	}
+
+	// после неудачи ручка не запрашивается до MinRefreshInterval
+	_, err = verifier.Verify(context.Background(), issued)
+	assert.ErrorIs(t, err, jwks.ErrUnknownKey)
+	assert.Equal(t, int32(1), requests.Load())
+}
@@ -0,0 +1,272 @@
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go-diploma/server/cookie"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Заголовки запроса партнёра.
+const (
+	HeaderKey        = `X-API-Key`
+	HeaderOnBehalfOf = `X-On-Behalf-Of`
+)
+
+// Права ключа.
+const (
+	ScopeOrdersWrite     = `orders:write`
+	ScopeOrdersRead      = `orders:read`
+	ScopeBalanceRead     = `balance:read`
+	ScopeWithdrawalsRead = `withdrawals:read`
+)
+
+const (
+	keyPrefix    = `gm_`
+	prefixLength = 11
+)
+
+var (
+	ErrInvalidKey   = errors.New(`invalid api key`)
+	ErrUnknownUser  = errors.New(`unknown user`)
+	ErrUnknownScope = errors.New(`unknown api key scope`)
+	ErrNotFound     = errors.New(`api key not found`)
+)
+
+var knownScopes = map[string]struct{}{
+	ScopeOrdersWrite:     {},
+	ScopeOrdersRead:      {},
+	ScopeBalanceRead:     {},
+	ScopeWithdrawalsRead: {},
+}
+
+// Key ключ партнёрской интеграции. Сам ключ не хранится, только его хэш
+// и начало (Prefix), по которому ключ можно узнать в списке.
+type Key struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  int        `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func (k Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateScopes
+// Ключ без прав или с неизвестным правом не создаётся.
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf(`empty scopes: %w`, ErrUnknownScope)
+	}
+	for _, scope := range scopes {
+		if _, ok := knownScopes[scope]; !ok {
+			return fmt.Errorf(scope+`: %w`, ErrUnknownScope)
+		}
+	}
+	return nil
+}
+
+type Store struct {
+	Pool *pgxpool.Pool
+}
+
+func (st *Store) Init(pool *pgxpool.Pool) {
+	st.Pool = pool
+}
+
+// Create
+// Возвращает ключ целиком. Показать его можно только один раз.
+func (st *Store) Create(ctx context.Context, name string, scopes []string, expiresAt *time.Time, createdBy int) (Key, string, error) {
+	if err := ValidateScopes(scopes); err != nil {
+		return Key{}, ``, err
+	}
+	secret, err := newKey()
+	if err != nil {
+		return Key{}, ``, err
+	}
+
+	key := Key{Name: name, Prefix: secret[:prefixLength], Scopes: scopes, CreatedBy: createdBy, ExpiresAt: expiresAt}
+	err = st.Pool.QueryRow(
+		ctx,
+		`insert into public.api_keys (name, prefix, key_hash, scopes, created_by, expires_at)
+			values ($1, $2, $3, $4, $5, $6)
+			returning id, created_at`,
+		name, key.Prefix, hashKey(secret), scopes, createdBy, expiresAt,
+	).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return Key{}, ``, err
+	}
+	return key, secret, nil
+}
+
+// Authenticate
+// Проверяет ключ и пользователя, от имени которого идёт запрос,
+// и отмечает время использования ключа.
+func (st *Store) Authenticate(ctx context.Context, secret string, userID int) (Key, error) {
+	var key Key
+	err := st.Pool.QueryRow(
+		ctx,
+		`update public.api_keys set last_used_at = now()
+			where key_hash = $1
+			  and revoked_at is null
+			  and (expires_at is null or expires_at > now())
+			returning id, name, prefix, scopes, coalesce(created_by, 0), created_at, expires_at, last_used_at`,
+		hashKey(secret),
+	).Scan(&key.ID, &key.Name, &key.Prefix, &key.Scopes, &key.CreatedBy, &key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Key{}, ErrInvalidKey
+		}
+		return Key{}, err
+	}
+
+	var exists bool
+	err = st.Pool.QueryRow(
+		ctx,
+		`select exists(select 1 from public.users where id = $1)`,
+		userID,
+	).Scan(&exists)
+	if err != nil {
+		return Key{}, err
+	}
+	if !exists {
+		return Key{}, ErrUnknownUser
+	}
+	return key, nil
+}
+
+func (st *Store) List(ctx context.Context) ([]Key, error) {
+	rows, err := st.Pool.Query(
+		ctx,
+		`select id, name, prefix, scopes, coalesce(created_by, 0), created_at, expires_at, revoked_at, last_used_at
+			from public.api_keys
+			order by id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]Key, 0)
+	for rows.Next() {
+		var key Key
+		err = rows.Scan(&key.ID, &key.Name, &key.Prefix, &key.Scopes, &key.CreatedBy, &key.CreatedAt,
+			&key.ExpiresAt, &key.RevokedAt, &key.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (st *Store) Revoke(ctx context.Context, id int) error {
+	tag, err := st.Pool.Exec(
+		ctx,
+		`update public.api_keys set revoked_at = now() where id = $1 and revoked_at is null`,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Authenticator проверка ключа, реализуется Store.
+type Authenticator interface {
+	Authenticate(ctx context.Context, secret string, userID int) (Key, error)
+}
+
+// AuthChecker
+// Запрос с X-API-Key проверяется как ключ партнёра и выполняется от имени
+// пользователя из X-On-Behalf-Of. Остальные запросы уходят в fallback (JWT).
+func AuthChecker(auth Authenticator, fallback func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		byToken := fallback(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			secret := r.Header.Get(HeaderKey)
+			if secret == `` {
+				byToken.ServeHTTP(w, r)
+				return
+			}
+
+			userID, err := strconv.Atoi(r.Header.Get(HeaderOnBehalfOf))
+			if err != nil || userID <= 0 {
+				http.Error(w, HeaderOnBehalfOf+` header is required`, http.StatusBadRequest)
+				return
+			}
+			key, err := auth.Authenticate(r.Context(), secret, userID)
+			if err != nil {
+				switch {
+				case errors.Is(err, ErrInvalidKey):
+					http.Error(w, `unauthorized`, http.StatusUnauthorized)
+				case errors.Is(err, ErrUnknownUser):
+					http.Error(w, ErrUnknownUser.Error(), http.StatusForbidden)
+				default:
+					http.Error(w, `internal error`, http.StatusInternalServerError)
+				}
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), cookie.UserNum(`UserID`), userID)
+			ctx = context.WithValue(ctx, cookie.UserNum(`AuthMethod`), cookie.AuthByAPIKey)
+			ctx = context.WithValue(ctx, cookie.UserNum(`APIKey`), key)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireScope
+// Ключу нужно право scope. Пользователей с токеном не ограничивает.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if method, _ := r.Context().Value(cookie.UserNum(`AuthMethod`)).(string); method == cookie.AuthByAPIKey {
+				key, _ := r.Context().Value(cookie.UserNum(`APIKey`)).(Key)
+				if !key.HasScope(scope) {
+					http.Error(w, `api key has no scope `+scope, http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func newKey() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return ``, err
+	}
+	return keyPrefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// hashKey ключ случайный и длинный, поэтому медленный хэш паролей не нужен.
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(secret)))
+	return hex.EncodeToString(sum[:])
+}
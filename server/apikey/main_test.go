@@ -0,0 +1,113 @@
+package apikey
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-diploma/server/cookie"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeKeys map[string]Key
+
+func (f fakeKeys) Authenticate(_ context.Context, secret string, userID int) (Key, error) {
+	key, ok := f[secret]
+	if !ok {
+		return Key{}, ErrInvalidKey
+	}
+	if userID != 1 {
+		return Key{}, ErrUnknownUser
+	}
+	return key, nil
+}
+
+func TestValidateScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		err    error
+	}{
+		{name: `Test known scopes`, scopes: []string{ScopeOrdersWrite, ScopeBalanceRead}, err: nil},
+		{name: `Test empty scopes`, scopes: nil, err: ErrUnknownScope},
+		{name: `Test unknown scope`, scopes: []string{ScopeOrdersRead, `balance:withdraw`}, err: ErrUnknownScope},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, ValidateScopes(tt.scopes), tt.err)
+		})
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	first, err := newKey()
+	require.NoError(t, err)
+	second, err := newKey()
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(first, keyPrefix))
+	assert.NotEqual(t, first, second)
+	assert.Len(t, hashKey(first), 64)
+	assert.NotEqual(t, hashKey(first), hashKey(second))
+}
+
+func TestAuthChecker(t *testing.T) {
+	keys := fakeKeys{
+		`gm_orders`: {ID: 1, Scopes: []string{ScopeOrdersWrite}},
+	}
+	fallback := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(`Authorization`) == `` {
+				http.Error(w, `unauthorized`, http.StatusUnauthorized)
+				return
+			}
+			ctx := context.WithValue(r.Context(), cookie.UserNum(`AuthMethod`), cookie.AuthByBearer)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	router := func(scope string) http.Handler {
+		return AuthChecker(keys, fallback)(RequireScope(scope)(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}),
+		))
+	}
+
+	tests := []struct {
+		name       string
+		scope      string
+		key        string
+		onBehalfOf string
+		bearer     bool
+		status     int
+	}{
+		{name: `Test key with scope`, scope: ScopeOrdersWrite, key: `gm_orders`, onBehalfOf: `1`, status: http.StatusOK},
+		{name: `Test key without scope`, scope: ScopeBalanceRead, key: `gm_orders`, onBehalfOf: `1`, status: http.StatusForbidden},
+		{name: `Test unknown key`, scope: ScopeOrdersWrite, key: `gm_unknown`, onBehalfOf: `1`, status: http.StatusUnauthorized},
+		{name: `Test missing on behalf of`, scope: ScopeOrdersWrite, key: `gm_orders`, status: http.StatusBadRequest},
+		{name: `Test unknown user`, scope: ScopeOrdersWrite, key: `gm_orders`, onBehalfOf: `2`, status: http.StatusForbidden},
+		{name: `Test token user is not limited by scope`, scope: ScopeBalanceRead, bearer: true, status: http.StatusOK},
+		{name: `Test no credentials`, scope: ScopeBalanceRead, status: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, `/api/user/balance`, nil)
+			if tt.key != `` {
+				req.Header.Set(HeaderKey, tt.key)
+			}
+			if tt.onBehalfOf != `` {
+				req.Header.Set(HeaderOnBehalfOf, tt.onBehalfOf)
+			}
+			if tt.bearer {
+				req.Header.Set(`Authorization`, `Bearer token`)
+			}
+			rec := httptest.NewRecorder()
+			router(tt.scope).ServeHTTP(rec, req)
+			assert.Equal(t, tt.status, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Типы событий безопасности.
+const (
+	EventRegister              = `register`
+	EventLoginSuccess          = `login_success`
+	EventLoginFailure          = `login_failure`
+	EventPasswordChange        = `password_change`
+	EventPasswordChangeFailure = `password_change_failure`
+	EventPasswordResetRequest  = `password_reset_request`
+	EventPasswordReset         = `password_reset`
+	EventEmailChange           = `email_change`
+	EventEmailChangeFailure    = `email_change_failure`
+	EventWithdraw              = `withdraw`
+	EventWithdrawFailure       = `withdraw_failure`
+	EventBalanceAdjustment     = `balance_adjustment`
+	EventLedgerReversal        = `ledger_reversal`
+)
+
+const (
+	DefaultLimit = 50
+	MaxLimit     = 200
+)
+
+// Event событие безопасности. UserID = 0 - пользователь не определён
+// (например, вход с несуществующим логином).
+type Event struct {
+	ID        int64             `json:"id"`
+	UserID    int               `json:"user_id,omitempty"`
+	Login     string            `json:"login,omitempty"`
+	Type      string            `json:"type"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"user_agent"`
+	Details   map[string]string `json:"details,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// Filter выборка событий. Пустые поля не ограничивают выборку,
+// BeforeID - курсор: события с меньшим ID (страницы от новых к старым).
+type Filter struct {
+	UserID   int
+	Login    string
+	Type     string
+	Since    time.Time
+	Until    time.Time
+	BeforeID int64
+	Limit    int
+}
+
+// Recorder единая точка записи событий безопасности для обработчиков.
+type Recorder struct {
+	Pool   *pgxpool.Pool
+	Logger *zap.Logger
+}
+
+func (r *Recorder) Init(pool *pgxpool.Pool, l *zap.Logger) {
+	r.Pool = pool
+	r.Logger = l
+}
+
+// Record
+// Ошибка записи не должна ломать запрос пользователя, поэтому она только логируется.
+func (r *Recorder) Record(ctx context.Context, e Event) {
+	details := e.Details
+	if details == nil {
+		details = map[string]string{}
+	}
+	marshaled, err := json.Marshal(details)
+	if err != nil {
+		r.Logger.Error(err.Error())
+		return
+	}
+
+	var userID *int
+	if e.UserID > 0 {
+		userID = &e.UserID
+	}
+	_, err = r.Pool.Exec(
+		ctx,
+		`insert into public.security_events (user_id, login, type, ip, user_agent, details)
+			values ($1, $2, $3, $4, $5, $6)`,
+		userID, e.Login, e.Type, e.IP, e.UserAgent, marshaled,
+	)
+	if err != nil {
+		r.Logger.Error(`security event ` + e.Type + ` not recorded: ` + err.Error())
+	}
+}
+
+func (r *Recorder) List(ctx context.Context, f Filter) ([]Event, error) {
+	query, args := f.query()
+	rows, err := r.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]Event, 0)
+	for rows.Next() {
+		var e Event
+		var userID *int
+		var details []byte
+		err = rows.Scan(&e.ID, &userID, &e.Login, &e.Type, &e.IP, &e.UserAgent, &details, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if userID != nil {
+			e.UserID = *userID
+		}
+		if err = json.Unmarshal(details, &e.Details); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// query собирает запрос только из заданных условий фильтра.
+func (f Filter) query() (string, []any) {
+	var conditions []string
+	var args []any
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, strings.ReplaceAll(condition, `?`, `$`+strconv.Itoa(len(args))))
+	}
+
+	if f.UserID > 0 {
+		add(`user_id = ?`, f.UserID)
+	}
+	if f.Login != `` {
+		add(`login = ?`, f.Login)
+	}
+	if f.Type != `` {
+		add(`type = ?`, f.Type)
+	}
+	if !f.Since.IsZero() {
+		add(`created_at >= ?`, f.Since)
+	}
+	if !f.Until.IsZero() {
+		add(`created_at < ?`, f.Until)
+	}
+	if f.BeforeID > 0 {
+		add(`id < ?`, f.BeforeID)
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	query := `select id, user_id, login, type, ip, user_agent, details, created_at from public.security_events`
+	if len(conditions) > 0 {
+		query += ` where ` + strings.Join(conditions, ` and `)
+	}
+	query += ` order by id desc limit ` + strconv.Itoa(limit)
+	return query, args
+}
@@ -0,0 +1,46 @@
+package audit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFilter_Query(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	base := `select id, user_id, login, type, ip, user_agent, details, created_at from public.security_events`
+
+	tests := []struct {
+		name   string
+		filter Filter
+		query  string
+		args   []any
+	}{
+		{
+			name:   `Test no filter`,
+			filter: Filter{},
+			query:  base + ` order by id desc limit 50`,
+			args:   nil,
+		},
+		{
+			name:   `Test user events page`,
+			filter: Filter{UserID: 7, BeforeID: 100, Limit: 10},
+			query:  base + ` where user_id = $1 and id < $2 order by id desc limit 10`,
+			args:   []any{7, int64(100)},
+		},
+		{
+			name:   `Test admin filter`,
+			filter: Filter{Login: `alice`, Type: EventLoginFailure, Since: since, Limit: 1000},
+			query:  base + ` where login = $1 and type = $2 and created_at >= $3 order by id desc limit 200`,
+			args:   []any{`alice`, EventLoginFailure, since},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := tt.filter.query()
+			assert.Equal(t, tt.query, query)
+			assert.Equal(t, tt.args, args)
+		})
+	}
+}
@@ -6,20 +6,149 @@ import (
 	"flag"
 	"fmt"
 	"github.com/caarlos0/env/v6"
+	"go-diploma/internal/utils/money"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Config struct {
 	StartStandalone    string
 	Command            string
+	Login              string
 	Mode               string
 	DatabaseConnection string `env:"DATABASE_URI"`
 	MartAddress        string `env:"RUN_ADDRESS"`
 	AccrualAddress     string `env:"ACCRUAL_SYSTEM_ADDRESS"`
+	PasswordHash       PasswordHashCfg
+	JWT                JWTCfg
+	Cookie             CookieCfg
+	Lockout            LockoutCfg
+	PasswordPolicy     PasswordPolicyCfg
+	LoginPolicy        LoginPolicyCfg
+	Control            ControlCfg
+	TOTP               TOTPCfg
+	Mail               MailCfg
+	PasswordReset      PasswordResetCfg
+	Idempotency        IdempotencyCfg
 	LocalConfig        LocalCfg
 }
 
+// LockoutCfg защита входа от подбора пароля.
+// После LoginAttempts (IPAttempts для адреса клиента) неудачных попыток вход блокируется
+// на BaseDelay, каждая следующая ошибка удваивает блокировку до MaxDelay.
+type LockoutCfg struct {
+	LoginAttempts int           `env:"LOCKOUT_LOGIN_ATTEMPTS" envDefault:"5"`
+	IPAttempts    int           `env:"LOCKOUT_IP_ATTEMPTS" envDefault:"20"`
+	BaseDelay     time.Duration `env:"LOCKOUT_BASE_DELAY" envDefault:"1s"`
+	MaxDelay      time.Duration `env:"LOCKOUT_MAX_DELAY" envDefault:"15m"`
+	ResetAfter    time.Duration `env:"LOCKOUT_RESET_AFTER" envDefault:"1h"`
+}
+
+// PasswordPolicyCfg требования к новым паролям.
+// Require - классы символов через запятую: lower,upper,digit,symbol.
+// DenylistFile дополняет встроенный список распространённых паролей.
+type PasswordPolicyCfg struct {
+	MinLength    int      `env:"PASSWORD_MIN_LENGTH" envDefault:"8"`
+	MaxLength    int      `env:"PASSWORD_MAX_LENGTH" envDefault:"128"`
+	Require      []string `env:"PASSWORD_REQUIRE" envSeparator:","`
+	DenylistFile string   `env:"PASSWORD_DENYLIST_FILE"`
+}
+
+// LoginPolicyCfg требования к логину при регистрации.
+// Логин сравнивается без учёта регистра и пробелов по краям, Pattern проверяется
+// для уже нормализованного логина (по умолчанию латиница, цифры и . _ @ -).
+type LoginPolicyCfg struct {
+	MinLength int    `env:"LOGIN_MIN_LENGTH" envDefault:"3"`
+	MaxLength int    `env:"LOGIN_MAX_LENGTH" envDefault:"64"`
+	Pattern   string `env:"LOGIN_PATTERN"`
+}
+
+// PasswordHashCfg параметры argon2id для хэширования паролей.
+// При изменении параметров хэши пользователей перезаписываются при следующем входе.
+type PasswordHashCfg struct {
+	Time    uint32 `env:"PASSWORD_HASH_TIME" envDefault:"3"`
+	Memory  uint32 `env:"PASSWORD_HASH_MEMORY" envDefault:"65536"`
+	Threads uint8  `env:"PASSWORD_HASH_THREADS" envDefault:"2"`
+}
+
+// JWTCfg параметры подписи токенов.
+// Keys - список ключей вида "kid:secret,kid2:secret2",
+// KeysDir - каталог с файлами <kid>.key (HMAC секрет) и <kid>.pem (закрытый ключ RSA или Ed25519).
+// Открытые части RSA и Ed25519 ключей публикуются на /.well-known/jwks.json.
+// Подписывается ключ ActiveKID, проверяются все загруженные ключи.
+// TTL - время жизни access-токена, RefreshTTL - время жизни сессии.
+type JWTCfg struct {
+	Keys       string        `env:"JWT_KEYS"`
+	KeysDir    string        `env:"JWT_KEYS_DIR"`
+	ActiveKID  string        `env:"JWT_ACTIVE_KID"`
+	Issuer     string        `env:"JWT_ISSUER" envDefault:"gophermart"`
+	Audience   string        `env:"JWT_AUDIENCE" envDefault:"gophermart"`
+	TTL        time.Duration `env:"JWT_TTL" envDefault:"15m"`
+	RefreshTTL time.Duration `env:"JWT_REFRESH_TTL" envDefault:"720h"`
+}
+
+// CookieCfg атрибуты cookie с токенами. Secure включается, когда сервис работает за HTTPS,
+// SameSite: lax, strict или none (none только вместе с Secure).
+// Изменяющие запросы с cookie-аутентификацией требуют заголовок X-CSRF-Token со значением
+// cookie csrf_token. API клиенты без браузера получают токены в теле ответа
+// (Accept: application/json) и передают их в заголовке Authorization: Bearer.
+type CookieCfg struct {
+	Secure   bool   `env:"COOKIE_SECURE" envDefault:"false"`
+	HTTPOnly bool   `env:"COOKIE_HTTP_ONLY" envDefault:"true"`
+	SameSite string `env:"COOKIE_SAMESITE" envDefault:"lax"`
+	Domain   string `env:"COOKIE_DOMAIN"`
+}
+
+// ControlCfg управляющий интерфейс: остановка, drain, уровень логов, статус.
+// Address - "unix:/path/to.sock" или "host:port". Для tcp обязателен Token,
+// доступ к сокету ограничен правами на файл (0600) и каталог (0700), Token для него
+// необязателен. По умолчанию - DefaultControlAddress.
+type ControlCfg struct {
+	Address string `env:"CONTROL_ADDRESS"`
+	Token   string `env:"CONTROL_TOKEN"`
+}
+
+// TOTPCfg второй фактор (RFC 6238). Skew - сколько соседних 30-секундных интервалов
+// принимается из-за расхождения часов. Списание больше WithdrawThreshold баллов
+// требует свежий код в заголовке X-TOTP-Code (0 - код нужен для любого списания).
+// EncryptionKey - 32 байта в base64 (openssl rand -base64 32), им шифруются секреты
+// в базе. Без ключа второй фактор недоступен.
+type TOTPCfg struct {
+	Issuer            string       `env:"TOTP_ISSUER" envDefault:"Gophermart"`
+	Skew              int          `env:"TOTP_SKEW" envDefault:"1"`
+	WithdrawThreshold money.Amount `env:"TOTP_WITHDRAW_THRESHOLD" envDefault:"1000"`
+	EncryptionKey     string       `env:"TOTP_ENCRYPTION_KEY"`
+}
+
+// MailCfg отправка писем. Driver: smtp, file (письма в каталог Dir) или log (по умолчанию,
+// письма не отправляются, в лог пишутся адрес и тема без тела).
+type MailCfg struct {
+	Driver       string `env:"MAIL_DRIVER" envDefault:"log"`
+	From         string `env:"MAIL_FROM" envDefault:"Gophermart <noreply@gophermart.local>"`
+	Dir          string `env:"MAIL_DIR" envDefault:"mail"`
+	SMTPAddress  string `env:"SMTP_ADDRESS"`
+	SMTPUsername string `env:"SMTP_USERNAME"`
+	SMTPPassword string `env:"SMTP_PASSWORD"`
+}
+
+// PasswordResetCfg восстановление пароля по почте. TTL - время жизни одноразового токена,
+// URL - адрес страницы сброса, токен дописывается в конец (пусто - в письме только токен).
+type PasswordResetCfg struct {
+	TTL time.Duration `env:"PASSWORD_RESET_TTL" envDefault:"30m"`
+	URL string        `env:"PASSWORD_RESET_URL"`
+}
+
+// IdempotencyCfg повтор POST запросов с заголовком Idempotency-Key. TTL - сколько хранится
+// ключ и ответ на запрос, после этого ключ можно использовать снова.
+// Lease - сколько ключ считается занятым запросом без ответа: если процесс упал посреди
+// запроса, повтор с тем же телом после Lease выполняется заново. Должен быть больше
+// времени выполнения самого долгого запроса.
+type IdempotencyCfg struct {
+	TTL   time.Duration `env:"IDEMPOTENCY_TTL" envDefault:"24h"`
+	Lease time.Duration `env:"IDEMPOTENCY_LEASE" envDefault:"1m"`
+}
+
 type LocalCfg struct {
 	App struct {
 		RootPath       string `json:"rootPath"`
@@ -56,16 +185,17 @@ type NewAccrualType struct {
 }
 
 type GetOrderData struct {
-	OrderNum   string      `json:"number"`
-	Status     string      `json:"status"`
-	Accrual    float32     `json:"accrual,omitempty"`
-	UploadedAt interface{} `json:"uploaded_at"`
+	OrderNum   string       `json:"number"`
+	Status     string       `json:"status"`
+	Accrual    money.Amount `json:"accrual,omitempty"`
+	UploadedAt interface{}  `json:"uploaded_at"`
 }
 
 var (
 	ErrEnv           = errors.New(`config env error`)
 	ErrFile          = errors.New(`config file error`)
 	ErrConfigConsist = errors.New(`not all params filled for start app`)
+	ErrPasswordHash  = errors.New(`PASSWORD_HASH_TIME, PASSWORD_HASH_MEMORY and PASSWORD_HASH_THREADS must be positive`)
 )
 
 // Init Заполняет данными
@@ -75,6 +205,12 @@ func (c *Config) Init() error {
 	if envErr != nil {
 		return fmt.Errorf(envErr.Error()+` : %w`, ErrEnv)
 	}
+	if c.PasswordHash.Time < 1 || c.PasswordHash.Memory < 1 || c.PasswordHash.Threads < 1 {
+		return ErrPasswordHash
+	}
+	if c.Control.Address == `` {
+		c.Control.Address = DefaultControlAddress()
+	}
 
 	if c.DatabaseConnection == `` || c.MartAddress == `` || c.AccrualAddress == `` {
 		flag.StringVar(&c.MartAddress, "a", "", "address and port to run server mart app")
@@ -83,7 +219,8 @@ func (c *Config) Init() error {
 	}
 	flag.StringVar(&c.StartStandalone, "standalone", "n", "working mode y/n, default n")
 	flag.StringVar(&c.Mode, "mode", "easy", "running mode easy/full, default easy")
-	flag.StringVar(&c.Command, "command", "start", "action command start/stop, default start. Use it when -standalone=y")
+	flag.StringVar(&c.Command, "command", "start", "action command start/stop/unlock/create-admin, default start. Use it when -standalone=y")
+	flag.StringVar(&c.Login, "login", "", "user login for -command=unlock and -command=create-admin")
 	flag.Parse()
 
 	if c.Mode == `full` {
@@ -113,6 +250,22 @@ func (c *Config) Init() error {
 	return nil
 }
 
+// DefaultControlAddress
+// Сокет в личном каталоге пользователя: $XDG_RUNTIME_DIR/gophermart/control.sock,
+// без него - ~/.gophermart/control.sock. Общий /tmp не подходит: там чужой процесс
+// может занять путь раньше сервиса.
+func DefaultControlAddress() string {
+	dir := os.Getenv(`XDG_RUNTIME_DIR`)
+	if dir == `` {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return `unix:gophermart-control.sock`
+		}
+		return `unix:` + filepath.Join(home, `.gophermart`, `control.sock`)
+	}
+	return `unix:` + filepath.Join(dir, `gophermart`, `control.sock`)
+}
+
 func (c *Config) Get() Config {
 	return *c
 }
@@ -0,0 +1,237 @@
+package control
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const unixPrefix = `unix:`
+
+var (
+	ErrTokenRequired = errors.New(`control token is required for tcp control address`)
+	ErrAddressInUse  = errors.New(`control socket is in use by another process`)
+)
+
+// Target то, чем управляет интерфейс. Реализуется сервером приложения.
+type Target interface {
+	// Shutdown останавливает приложение. Вызывается после ответа клиенту.
+	Shutdown()
+	// SetDraining включает (выключает) отказ новым запросам с 503.
+	SetDraining(draining bool)
+	Status() Status
+}
+
+type Status struct {
+	State     string    `json:"state"`
+	Mode      string    `json:"mode"`
+	StartedAt time.Time `json:"started_at"`
+	Uptime    string    `json:"uptime"`
+	Database  string    `json:"database"`
+	LogLevel  string    `json:"log_level"`
+}
+
+// Server управляющий HTTP интерфейс на отдельном адресе:
+// unix сокет ("unix:/path/to.sock") или tcp порт с обязательным токеном.
+//
+//	POST /shutdown      - остановка приложения
+//	POST /drain         - новые запросы получают 503
+//	POST /resume        - отмена drain
+//	GET|PUT /log-level  - уровень логов, {"level":"debug"}
+//	GET /status         - состояние приложения
+type Server struct {
+	Address  string
+	Token    string
+	Level    zap.AtomicLevel
+	Target   Target
+	Logger   *zap.Logger
+	HTTP     http.Server
+	listener net.Listener
+}
+
+func (c *Server) Init(address string, token string, level zap.AtomicLevel, target Target, l *zap.Logger) error {
+	if !strings.HasPrefix(address, unixPrefix) && token == `` {
+		return ErrTokenRequired
+	}
+	c.Address = address
+	c.Token = token
+	c.Level = level
+	c.Target = target
+	c.Logger = l
+	c.HTTP = http.Server{Handler: c.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	return nil
+}
+
+func (c *Server) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(c.checkToken)
+	r.Post(`/shutdown`, c.shutdown)
+	r.Post(`/drain`, c.drain(true))
+	r.Post(`/resume`, c.drain(false))
+	r.Method(http.MethodGet, `/log-level`, c.Level)
+	r.Method(http.MethodPut, `/log-level`, c.logLevel())
+	r.Get(`/status`, c.status)
+	return r
+}
+
+// Listen
+// Открывает сокет (порт). Устаревший файл сокета от упавшего процесса удаляется,
+// сокет живого процесса не трогается. Каталог сокета создаётся с правами 0700,
+// сам сокет создаётся уже с правами 0600 (umask), а не получает их после.
+func (c *Server) Listen() error {
+	network, address := split(c.Address)
+	if network == `unix` {
+		if err := os.MkdirAll(filepath.Dir(address), 0o700); err != nil {
+			return err
+		}
+		if conn, err := net.DialTimeout(network, address, time.Second); err == nil {
+			_ = conn.Close()
+			return ErrAddressInUse
+		}
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	restoreUmask := func() {}
+	if network == `unix` {
+		restoreUmask = privateUmask()
+	}
+	listener, err := net.Listen(network, address)
+	restoreUmask()
+	if err != nil {
+		return err
+	}
+	if network == `unix` {
+		if err = os.Chmod(address, 0o600); err != nil {
+			_ = listener.Close()
+			return err
+		}
+	}
+	c.listener = listener
+	return nil
+}
+
+func (c *Server) Serve() error {
+	err := c.HTTP.Serve(c.listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (c *Server) Stop(ctx context.Context) error {
+	if c.listener == nil {
+		return nil
+	}
+	// unix сокет удаляется при закрытии листенера
+	return c.HTTP.Shutdown(ctx)
+}
+
+func (c *Server) checkToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.Token != `` {
+			token := strings.TrimPrefix(r.Header.Get(`Authorization`), `Bearer `)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) != 1 {
+				http.Error(w, `unauthorized`, http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *Server) shutdown(res http.ResponseWriter, _ *http.Request) {
+	c.Logger.Info(`shutdown requested via control interface`)
+	res.WriteHeader(http.StatusOK)
+	// остановка закрывает и этот интерфейс, поэтому не ждём её в обработчике
+	go c.Target.Shutdown()
+}
+
+func (c *Server) drain(draining bool) http.HandlerFunc {
+	return func(res http.ResponseWriter, _ *http.Request) {
+		c.Target.SetDraining(draining)
+		if draining {
+			c.Logger.Info(`drain enabled via control interface`)
+		} else {
+			c.Logger.Info(`drain disabled via control interface`)
+		}
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+func (c *Server) logLevel() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		c.Level.ServeHTTP(res, req)
+		c.Logger.Info(`log level is ` + c.Level.String())
+	})
+}
+
+func (c *Server) status(res http.ResponseWriter, _ *http.Request) {
+	st := c.Target.Status()
+	st.LogLevel = c.Level.String()
+	marshaled, err := json.Marshal(st)
+	if err != nil {
+		c.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	res.Header().Add(`Content-Type`, `application/json`)
+	res.WriteHeader(http.StatusOK)
+	_, err = res.Write(marshaled)
+	if err != nil {
+		c.Logger.Error(err.Error())
+	}
+}
+
+// Client
+// HTTP клиент к управляющему интерфейсу по адресу из конфигурации.
+type Client struct {
+	Address string
+	Token   string
+	HTTP    *http.Client
+}
+
+func NewClient(address string, token string) *Client {
+	network, addr := split(address)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	return &Client{
+		Address: address,
+		Token:   token,
+		HTTP:    &http.Client{Transport: transport, Timeout: 15 * time.Second},
+	}
+}
+
+// Do отправляет команду и возвращает ответ, тело закрывает вызывающий.
+func (cl *Client) Do(ctx context.Context, method string, path string, body string) (*http.Response, error) {
+	// хост в URL не используется: соединение открывает DialContext
+	req, err := http.NewRequestWithContext(ctx, method, `http://control`+path, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if cl.Token != `` {
+		req.Header.Set(`Authorization`, `Bearer `+cl.Token)
+	}
+	return cl.HTTP.Do(req)
+}
+
+func split(address string) (string, string) {
+	if strings.HasPrefix(address, unixPrefix) {
+		return `unix`, strings.TrimPrefix(address, unixPrefix)
+	}
+	return `tcp`, address
+}
@@ -0,0 +1,155 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeTarget struct {
+	shutdown chan struct{}
+	draining bool
+}
+
+func (f *fakeTarget) Shutdown() {
+	close(f.shutdown)
+}
+
+func (f *fakeTarget) SetDraining(draining bool) {
+	f.draining = draining
+}
+
+func (f *fakeTarget) Status() Status {
+	st := Status{State: `running`, Mode: `easy`}
+	if f.draining {
+		st.State = `draining`
+	}
+	return st
+}
+
+func newTestServer(t *testing.T, address string, token string) (*Server, *fakeTarget) {
+	target := &fakeTarget{shutdown: make(chan struct{})}
+	var c Server
+	err := c.Init(address, token, zap.NewAtomicLevelAt(zap.InfoLevel), target, zap.NewNop())
+	require.NoError(t, err)
+	return &c, target
+}
+
+func TestServer_Init(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		token   string
+		err     error
+	}{
+		{name: `Test unix socket without token`, address: `unix:/tmp/test.sock`, err: nil},
+		{name: `Test tcp with token`, address: `127.0.0.1:9090`, token: `secret`, err: nil},
+		{name: `Test tcp without token`, address: `127.0.0.1:9090`, err: ErrTokenRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Server
+			err := c.Init(tt.address, tt.token, zap.NewAtomicLevel(), &fakeTarget{}, zap.NewNop())
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestServer_Handler(t *testing.T) {
+	c, target := newTestServer(t, `127.0.0.1:0`, `control-secret`)
+	handler := c.Handler()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		token  string
+		status int
+		want   string
+	}{
+		{name: `Test no token`, method: http.MethodGet, path: `/status`, status: http.StatusUnauthorized},
+		{name: `Test wrong token`, method: http.MethodGet, path: `/status`, token: `wrong`, status: http.StatusUnauthorized},
+		{name: `Test status`, method: http.MethodGet, path: `/status`, token: `control-secret`, status: http.StatusOK, want: `"state":"running"`},
+		{name: `Test drain`, method: http.MethodPost, path: `/drain`, token: `control-secret`, status: http.StatusOK},
+		{name: `Test status while draining`, method: http.MethodGet, path: `/status`, token: `control-secret`, status: http.StatusOK, want: `"state":"draining"`},
+		{name: `Test resume`, method: http.MethodPost, path: `/resume`, token: `control-secret`, status: http.StatusOK},
+		{name: `Test set log level`, method: http.MethodPut, path: `/log-level`, body: `{"level":"debug"}`, token: `control-secret`, status: http.StatusOK},
+		{name: `Test get log level`, method: http.MethodGet, path: `/log-level`, token: `control-secret`, status: http.StatusOK, want: `"level":"debug"`},
+		{name: `Test bad log level`, method: http.MethodPut, path: `/log-level`, body: `{"level":"loud"}`, token: `control-secret`, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != `` {
+				req.Header.Set(`Authorization`, `Bearer `+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.status, rec.Code)
+			if tt.want != `` {
+				assert.Contains(t, rec.Body.String(), tt.want)
+			}
+		})
+	}
+	assert.False(t, target.draining)
+}
+
+func TestServer_UnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), `run`, `control.sock`)
+	c, target := newTestServer(t, `unix:`+socket, ``)
+	require.NoError(t, c.Listen())
+	go func() {
+		assert.NoError(t, c.Serve())
+	}()
+
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(socket))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+
+	// второй экземпляр не должен перехватить сокет работающего
+	other, _ := newTestServer(t, `unix:`+socket, ``)
+	assert.ErrorIs(t, other.Listen(), ErrAddressInUse)
+
+	client := NewClient(`unix:`+socket, ``)
+	response, err := client.Do(context.Background(), http.MethodGet, `/status`, ``)
+	require.NoError(t, err)
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	var st Status
+	require.NoError(t, json.Unmarshal(body, &st))
+	assert.Equal(t, `running`, st.State)
+	assert.Equal(t, `info`, st.LogLevel)
+
+	response, err = client.Do(context.Background(), http.MethodPost, `/shutdown`, ``)
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	select {
+	case <-target.shutdown:
+	case <-time.After(time.Second):
+		t.Fatal(`shutdown was not called`)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, c.Stop(ctx))
+	_, err = os.Stat(socket)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package control
+
+// privateUmask без umask права на сокет ставит только Chmod после Listen.
+func privateUmask() func() {
+	return func() {}
+}
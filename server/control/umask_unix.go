@@ -0,0 +1,13 @@
+//go:build unix
+
+package control
+
+import "syscall"
+
+// privateUmask файлы создаются только с правами владельца, пока не вызвана возвращённая функция.
+func privateUmask() func() {
+	old := syscall.Umask(0o077)
+	return func() {
+		syscall.Umask(old)
+	}
+}
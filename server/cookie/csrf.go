@@ -0,0 +1,102 @@
+package cookie
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"go-diploma/server/config"
+	"net/http"
+	"strings"
+)
+
+const (
+	CSRFCookie = `csrf_token`
+	CSRFHeader = `X-CSRF-Token`
+)
+
+var (
+	ErrSameSite     = errors.New(`cookie SameSite must be lax, strict or none`)
+	ErrInsecureNone = errors.New(`cookie SameSite=none requires Secure`)
+)
+
+// Attributes общие атрибуты cookie, которые выставляет сервер.
+type Attributes struct {
+	Secure   bool
+	HTTPOnly bool
+	SameSite http.SameSite
+	Domain   string
+}
+
+func NewAttributes(c config.CookieCfg) (Attributes, error) {
+	a := Attributes{Secure: c.Secure, HTTPOnly: c.HTTPOnly, Domain: c.Domain}
+	switch strings.ToLower(c.SameSite) {
+	case `lax`, ``:
+		a.SameSite = http.SameSiteLaxMode
+	case `strict`:
+		a.SameSite = http.SameSiteStrictMode
+	case `none`:
+		if !c.Secure {
+			return a, ErrInsecureNone
+		}
+		a.SameSite = http.SameSiteNoneMode
+	default:
+		return a, fmt.Errorf(c.SameSite+`: %w`, ErrSameSite)
+	}
+	return a, nil
+}
+
+// Apply проставляет атрибуты в cookie и возвращает её же.
+func (a Attributes) Apply(c *http.Cookie) *http.Cookie {
+	c.Secure = a.Secure
+	c.HttpOnly = a.HTTPOnly
+	c.SameSite = a.SameSite
+	c.Domain = a.Domain
+	return c
+}
+
+// CSRFCookieFor
+// Cookie с CSRF токеном. Её читает скрипт страницы, поэтому HttpOnly не ставится.
+func (a Attributes) CSRFCookieFor(token string) *http.Cookie {
+	c := a.Apply(&http.Cookie{Name: CSRFCookie, Value: token, Path: `/`})
+	c.HttpOnly = false
+	return c
+}
+
+func NewCSRFToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return ``, err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// CSRFChecker
+// Double submit: изменяющий запрос с токеном из cookie должен повторить значение
+// cookie csrf_token в заголовке X-CSRF-Token. Чужой сайт cookie прочитать не может.
+// Ставится после AuthChecker: Bearer и API ключи браузер сам не подставляет, их не проверяем.
+func CSRFChecker(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, _ := r.Context().Value(UserNum(`AuthMethod`)).(string)
+		if method != AuthByCookie || safeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		csrf, err := r.Cookie(CSRFCookie)
+		header := r.Header.Get(CSRFHeader)
+		if err != nil || csrf.Value == `` || subtle.ConstantTimeCompare([]byte(csrf.Value), []byte(header)) != 1 {
+			http.Error(w, `csrf token mismatch`, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package cookie
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"go-diploma/pkg/jwks"
+	"go-diploma/server/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Key ключ подписи токенов, ID попадает в заголовок kid.
+// HS256 ключ хранит общий секрет, RS256 и EdDSA - пару ключей,
+// открытая часть которой публикуется в JWKS.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Secret  []byte
+	Private crypto.Signer
+}
+
+func (k Key) signingKey() interface{} {
+	if k.Private != nil {
+		return k.Private
+	}
+	return k.Secret
+}
+
+func (k Key) verifyingKey() interface{} {
+	if k.Private != nil {
+		return k.Private.Public()
+	}
+	return k.Secret
+}
+
+const (
+	keyFileExt   = `.key`
+	pemFileExt   = `.pem`
+	minSecretLen = 32
+	minRSABits   = 2048
+)
+
+var (
+	ErrNoActiveKey = errors.New(`active signing key is not set`)
+	ErrWeakKey     = errors.New(`signing key is too short`)
+	ErrKeyFormat   = errors.New(`signing keys format is "kid:secret,kid2:secret2"`)
+	ErrPEMKey      = errors.New(`pem file must contain RSA or Ed25519 private key`)
+)
+
+// LoadKeys собирает ключи из JWT_KEYS и каталога JWT_KEYS_DIR:
+// <kid>.key - HMAC секрет, <kid>.pem - закрытый ключ RSA или Ed25519.
+// Если ключей нет совсем, генерирует случайный ключ на время жизни процесса.
+func LoadKeys(c config.JWTCfg) (map[string]Key, string, bool, error) {
+	keys := make(map[string]Key)
+
+	if c.Keys != `` {
+		for _, pair := range strings.Split(c.Keys, `,`) {
+			kid, secret, found := strings.Cut(strings.TrimSpace(pair), `:`)
+			if !found || kid == `` {
+				return nil, ``, false, ErrKeyFormat
+			}
+			keys[kid] = Key{ID: kid, Method: jwt.SigningMethodHS256, Secret: []byte(secret)}
+		}
+	}
+
+	if c.KeysDir != `` {
+		files, err := filepath.Glob(filepath.Join(c.KeysDir, `*`+keyFileExt))
+		if err != nil {
+			return nil, ``, false, err
+		}
+		for _, file := range files {
+			secret, err := os.ReadFile(file)
+			if err != nil {
+				return nil, ``, false, err
+			}
+			kid := strings.TrimSuffix(filepath.Base(file), keyFileExt)
+			keys[kid] = Key{ID: kid, Method: jwt.SigningMethodHS256, Secret: []byte(strings.TrimSpace(string(secret)))}
+		}
+
+		files, err = filepath.Glob(filepath.Join(c.KeysDir, `*`+pemFileExt))
+		if err != nil {
+			return nil, ``, false, err
+		}
+		for _, file := range files {
+			kid := strings.TrimSuffix(filepath.Base(file), pemFileExt)
+			key, err := loadPEMKey(kid, file)
+			if err != nil {
+				return nil, ``, false, err
+			}
+			keys[kid] = key
+		}
+	}
+
+	if len(keys) == 0 {
+		key, err := randomKey()
+		if err != nil {
+			return nil, ``, false, err
+		}
+		keys[key.ID] = key
+		return keys, key.ID, true, nil
+	}
+
+	for _, key := range keys {
+		if key.Private == nil && len(key.Secret) < minSecretLen {
+			return nil, ``, false, fmt.Errorf(`kid "%s": %w`, key.ID, ErrWeakKey)
+		}
+	}
+
+	activeKID := c.ActiveKID
+	if activeKID == `` && len(keys) == 1 {
+		for kid := range keys {
+			activeKID = kid
+		}
+	}
+	if _, ok := keys[activeKID]; !ok {
+		return nil, ``, false, fmt.Errorf(`kid "%s" among %v: %w`, activeKID, keyIDs(keys), ErrNoActiveKey)
+	}
+
+	return keys, activeKID, false, nil
+}
+
+func randomKey() (Key, error) {
+	secret := make([]byte, minSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
+	}
+	return Key{ID: `ephemeral-` + hex.EncodeToString(secret[:4]), Method: jwt.SigningMethodHS256, Secret: secret}, nil
+}
+
+func loadPEMKey(kid string, file string) (Key, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return Key{}, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return Key{}, fmt.Errorf(`kid "%s": %w`, kid, ErrPEMKey)
+	}
+
+	var private interface{}
+	switch block.Type {
+	case `RSA PRIVATE KEY`:
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return Key{}, fmt.Errorf(`kid "%s": `+err.Error()+`: %w`, kid, ErrPEMKey)
+	}
+	return NewAsymmetricKey(kid, private)
+}
+
+// NewAsymmetricKey оборачивает закрытый ключ RSA или Ed25519 в ключ подписи.
+func NewAsymmetricKey(kid string, private interface{}) (Key, error) {
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < minRSABits {
+			return Key{}, fmt.Errorf(`kid "%s": %w`, kid, ErrWeakKey)
+		}
+		return Key{ID: kid, Method: jwt.SigningMethodRS256, Private: k}, nil
+	case ed25519.PrivateKey:
+		return Key{ID: kid, Method: jwt.SigningMethodEdDSA, Private: k}, nil
+	default:
+		return Key{}, fmt.Errorf(`kid "%s": %T: %w`, kid, private, ErrPEMKey)
+	}
+}
+
+// PublicKeys
+// Открытые ключи для публикации в JWKS. HMAC секреты туда не попадают.
+func (t *Tokens) PublicKeys() jwks.Set {
+	set := jwks.Set{Keys: make([]jwks.JWK, 0, len(t.Keys))}
+	for _, kid := range keyIDs(t.Keys) {
+		key := t.Keys[kid]
+		if key.Private == nil {
+			continue
+		}
+		jwk, err := jwks.FromPublicKey(key.ID, key.Method.Alg(), key.Private.Public())
+		if err != nil {
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+func keyIDs(keys map[string]Key) []string {
+	ids := make([]string, 0, len(keys))
+	for kid := range keys {
+		ids = append(ids, kid)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -2,36 +2,133 @@ package cookie
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v4"
+	"go-diploma/server/config"
 	"net/http"
+	"strings"
 	"time"
 )
 
 type UserNum string
 
+// Способы, которыми клиент передал токен.
+const (
+	AuthByCookie = `cookie`
+	AuthByBearer = `bearer`
+	AuthByAPIKey = `api_key`
+)
+
+// Роли пользователей, они же значения утверждения role.
+const (
+	RoleUser     = `user`
+	RoleOperator = `operator`
+	RoleAdmin    = `admin`
+)
+
+// ChallengeTTL сколько живёт токен второго шага входа.
+const ChallengeTTL = 5 * time.Minute
+
 type Claims struct {
 	jwt.RegisteredClaims
-	UserID int
+	UserID    int
+	SessionID int    `json:"sid,omitempty"`
+	Role      string `json:"role,omitempty"`
+}
+
+// SessionChecker проверяет, что сессия токена не отозвана на сервере,
+// и отмечает время последнего запроса в ней.
+type SessionChecker interface {
+	Touch(ctx context.Context, sessionID int, userID int) error
 }
 
-const TokenExp = time.Hour * 48
-const SecretKey = "superPuperSecretKey"
+var validMethods = []string{
+	jwt.SigningMethodHS256.Alg(),
+	jwt.SigningMethodRS256.Alg(),
+	jwt.SigningMethodEdDSA.Alg(),
+}
+
+var (
+	ErrUnknownKey    = errors.New(`unknown signing key`)
+	ErrInvalidClaims = errors.New(`invalid token claims`)
+)
+
+// Tokens выпускает и проверяет токены пользователей.
+// Подпись - активным ключом, проверка - любым из загруженных,
+// поэтому ключи можно менять без разлогина пользователей.
+type Tokens struct {
+	Keys      map[string]Key
+	ActiveKID string
+	Issuer    string
+	Audience  string
+	TTL       time.Duration
+	// Ephemeral - ключи не заданы в конфигурации и сгенерированы при старте.
+	Ephemeral bool
+	Sessions  SessionChecker
+}
+
+func NewTokens(c config.JWTCfg) (*Tokens, error) {
+	keys, activeKID, ephemeral, err := LoadKeys(c)
+	if err != nil {
+		return nil, err
+	}
+	return &Tokens{
+		Keys:      keys,
+		ActiveKID: activeKID,
+		Issuer:    c.Issuer,
+		Audience:  c.Audience,
+		TTL:       c.TTL,
+		Ephemeral: ephemeral,
+	}, nil
+}
 
 // BuildJWTString создаёт токен и возвращает его в виде строки.
-func BuildJWTString(userID int) (string, error) {
-	// создаём новый токен с алгоритмом подписи HS256 и утверждениями — Claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			// когда создан токен
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(TokenExp)),
-		},
-		// собственное утверждение
-		UserID: userID,
-	})
+func (t *Tokens) BuildJWTString(userID int, sessionID int, role string) (string, error) {
+	return t.sign(Claims{UserID: userID, SessionID: sessionID, Role: role}, t.Audience, t.TTL)
+}
+
+// Challenge токен второго шага входа. По ID сервер отмечает, что токен уже использован.
+type Challenge struct {
+	ID        string
+	UserID    int
+	ExpiresAt time.Time
+}
+
+// BuildChallenge
+// Токен второго шага входа (код TOTP). Выпускается для другой аудитории,
+// поэтому как access-токен не принимается.
+func (t *Tokens) BuildChallenge(userID int) (string, error) {
+	id, err := NewCSRFToken()
+	if err != nil {
+		return ``, err
+	}
+	claims := Claims{UserID: userID}
+	claims.ID = id
+	return t.sign(claims, t.challengeAudience(), ChallengeTTL)
+}
+
+func (t *Tokens) sign(claims Claims, audience string, ttl time.Duration) (string, error) {
+	key, ok := t.Keys[t.ActiveKID]
+	if !ok {
+		return ``, ErrUnknownKey
+	}
+
+	now := time.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID:        claims.ID,
+		Issuer:    t.Issuer,
+		Audience:  jwt.ClaimStrings{audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}
+	// создаём новый токен с алгоритмом подписи ключа и утверждениями — Claims
+	token := jwt.NewWithClaims(key.Method, claims)
+	// по kid проверяющая сторона выбирает ключ
+	token.Header[`kid`] = key.ID
 
 	// создаём строку токена
-	tokenString, err := token.SignedString([]byte(SecretKey))
+	tokenString, err := token.SignedString(key.signingKey())
 	if err != nil {
 		return "", err
 	}
@@ -39,22 +136,66 @@ func BuildJWTString(userID int) (string, error) {
 	// возвращаем строку токена
 	return tokenString, nil
 }
-func GetUserID(tokenString string) int {
+
+// ParseClaims проверяет подпись и утверждения токена.
+func (t *Tokens) ParseClaims(tokenString string) (*Claims, error) {
+	return t.parse(tokenString, t.Audience)
+}
+
+// ParseChallenge проверяет токен второго шага входа.
+func (t *Tokens) ParseChallenge(tokenString string) (Challenge, error) {
+	claims, err := t.parse(tokenString, t.challengeAudience())
+	if err != nil {
+		return Challenge{}, err
+	}
+	if claims.ID == `` {
+		return Challenge{}, ErrInvalidClaims
+	}
+	return Challenge{ID: claims.ID, UserID: claims.UserID, ExpiresAt: claims.ExpiresAt.Time}, nil
+}
+
+func (t *Tokens) challengeAudience() string {
+	return t.Audience + `:mfa`
+}
+
+func (t *Tokens) parse(tokenString string, audience string) (*Claims, error) {
 	// создаём экземпляр структуры с утверждениями
 	claims := &Claims{}
 	// парсим из строки токена tokenString в структуру claims
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header[`kid`].(string)
+		key, ok := t.Keys[kid]
+		if !ok {
+			return nil, fmt.Errorf(`kid "%s": %w`, kid, ErrUnknownKey)
 		}
-		return []byte(SecretKey), nil
-	})
-
+		// алгоритм задаёт ключ, а не заголовок токена
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.verifyingKey(), nil
+	}, jwt.WithValidMethods(validMethods))
 	if err != nil {
-		return -1
+		return nil, err
 	}
-
 	if !token.Valid {
+		return nil, ErrInvalidClaims
+	}
+
+	// exp и nbf проверены парсером, остальное обязательно для наших токенов
+	now := time.Now()
+	if claims.ExpiresAt == nil ||
+		!claims.VerifyIssuedAt(now, true) ||
+		!claims.VerifyIssuer(t.Issuer, true) ||
+		!claims.VerifyAudience(audience, true) {
+		return nil, ErrInvalidClaims
+	}
+
+	return claims, nil
+}
+
+func (t *Tokens) GetUserID(tokenString string) int {
+	claims, err := t.ParseClaims(tokenString)
+	if err != nil {
 		return -1
 	}
 
@@ -62,21 +203,65 @@ func GetUserID(tokenString string) int {
 	return claims.UserID
 }
 
-func AuthChecker(next http.Handler) http.Handler {
+// TokenFromRequest
+// Достаёт токен из заголовка Authorization: Bearer, а если его нет - из cookie.
+// Заголовок с другой схемой (например, Basic от прокси) не наш и не учитывается.
+func TokenFromRequest(r *http.Request) (string, string, bool) {
+	scheme, bearer, _ := strings.Cut(r.Header.Get(`Authorization`), ` `)
+	if strings.EqualFold(scheme, `Bearer`) {
+		if strings.TrimSpace(bearer) == `` {
+			return ``, ``, false
+		}
+		return strings.TrimSpace(bearer), AuthByBearer, true
+	}
+	token, err := r.Cookie("token")
+	if err != nil || token.Value == `` {
+		return ``, ``, false
+	}
+	return token.Value, AuthByCookie, true
+}
+
+func (t *Tokens) AuthChecker(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, err := r.Cookie("token")
-		if err != nil {
+		token, method, ok := TokenFromRequest(r)
+		if !ok {
 			http.Error(w, `unauthorized`, http.StatusUnauthorized)
 			return
 		}
-		UserID := GetUserID(token.Value)
-		if UserID > 0 {
-			userNumber := UserNum(`UserID`)
-			ctx := context.WithValue(r.Context(), userNumber, UserID)
-			newReqCtx := r.WithContext(ctx)
-			next.ServeHTTP(w, newReqCtx)
+		claims, err := t.ParseClaims(token)
+		if err != nil || claims.UserID <= 0 {
+			http.Error(w, `unauthorized`, http.StatusUnauthorized)
 			return
 		}
-		http.Error(w, `unauthorized`, http.StatusUnauthorized)
+		if t.Sessions != nil {
+			err = t.Sessions.Touch(r.Context(), claims.SessionID, claims.UserID)
+			if err != nil {
+				http.Error(w, `unauthorized`, http.StatusUnauthorized)
+				return
+			}
+		}
+		ctx := context.WithValue(r.Context(), UserNum(`UserID`), claims.UserID)
+		ctx = context.WithValue(ctx, UserNum(`SessionID`), claims.SessionID)
+		ctx = context.WithValue(ctx, UserNum(`AuthMethod`), method)
+		ctx = context.WithValue(ctx, UserNum(`Role`), claims.Role)
+		newReqCtx := r.WithContext(ctx)
+		next.ServeHTTP(w, newReqCtx)
 	})
 }
+
+// RequireRole
+// Пропускает только пользователей с одной из ролей. Ставится после AuthChecker.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, _ := r.Context().Value(UserNum(`Role`)).(string)
+			for _, allowed := range roles {
+				if role == allowed {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			http.Error(w, `forbidden`, http.StatusForbidden)
+		})
+	}
+}
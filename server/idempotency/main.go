@@ -0,0 +1,268 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go-diploma/server/cookie"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	HeaderKey      = `Idempotency-Key`
+	HeaderReplayed = `Idempotent-Replayed`
+	MaxKeyLength   = 255
+	// PurgeInterval как часто фоновый процесс удаляет просроченные ключи.
+	PurgeInterval = time.Hour
+)
+
+var (
+	ErrKeyMismatch = errors.New(`idempotency key was used with a different request`)
+	ErrInProgress  = errors.New(`request with this idempotency key is in progress`)
+)
+
+// Response сохранённый ответ, который отдаётся повторно.
+type Response struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Keys хранилище ключей, в тестах подменяется.
+type Keys interface {
+	Begin(ctx context.Context, userID int, key, requestHash string) (*Response, error)
+	Complete(ctx context.Context, userID int, key string, r Response) error
+	Release(ctx context.Context, userID int, key string) error
+}
+
+// Store ключи идемпотентности пользователей. Ключ действует TTL с первого запроса,
+// запрос без сохранённого ответа держит ключ не дольше Lease.
+type Store struct {
+	Pool  *pgxpool.Pool
+	TTL   time.Duration
+	Lease time.Duration
+}
+
+func (st *Store) Init(pool *pgxpool.Pool, ttl, lease time.Duration) {
+	st.Pool = pool
+	st.TTL = ttl
+	st.Lease = lease
+}
+
+// Begin
+// Занимает ключ за запросом. Если ключ уже занят, возвращает сохранённый ответ,
+// ErrInProgress - первый запрос ещё выполняется, ErrKeyMismatch - ключ был у другого запроса.
+// Просроченный ключ занимается заново. Ключ без ответа, у которого истёк Lease (процесс упал
+// посреди запроса), занимается повтором того же запроса.
+func (st *Store) Begin(ctx context.Context, userID int, key, requestHash string) (*Response, error) {
+	var claimed bool
+	err := st.Pool.QueryRow(
+		ctx,
+		`insert into public.idempotency_keys (user_id, key, request_hash, expires_at, locked_until)
+			values ($1, $2, $3, now() + $4::interval, now() + $5::interval)
+			on conflict (user_id, key) do update
+				set request_hash = excluded.request_hash, status = null, content_type = '', body = null,
+					created_at = now(), expires_at = excluded.expires_at, locked_until = excluded.locked_until
+				where idempotency_keys.expires_at <= now()
+					or (idempotency_keys.status is null and idempotency_keys.locked_until <= now()
+						and idempotency_keys.request_hash = excluded.request_hash)
+			returning true`,
+		userID, key, requestHash, st.TTL, st.Lease,
+	).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	var storedHash string
+	var status *int
+	var r Response
+	err = st.Pool.QueryRow(
+		ctx,
+		`select request_hash, status, content_type, coalesce(body, '') from public.idempotency_keys
+			where user_id = $1 and key = $2`,
+		userID, key,
+	).Scan(&storedHash, &status, &r.ContentType, &r.Body)
+	if err != nil {
+		// ключ успели освободить между запросами - пусть клиент повторит
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrInProgress
+		}
+		return nil, err
+	}
+	if storedHash != requestHash {
+		return nil, ErrKeyMismatch
+	}
+	if status == nil {
+		return nil, ErrInProgress
+	}
+	r.Status = *status
+	return &r, nil
+}
+
+// Complete сохраняет ответ на запрос с ключом.
+func (st *Store) Complete(ctx context.Context, userID int, key string, r Response) error {
+	_, err := st.Pool.Exec(
+		ctx,
+		`update public.idempotency_keys set status = $3, content_type = $4, body = $5
+			where user_id = $1 and key = $2`,
+		userID, key, r.Status, r.ContentType, r.Body,
+	)
+	return err
+}
+
+// Release освобождает ключ, если ответ не сохранён: запрос можно повторить с тем же ключом.
+func (st *Store) Release(ctx context.Context, userID int, key string) error {
+	_, err := st.Pool.Exec(
+		ctx,
+		`delete from public.idempotency_keys where user_id = $1 and key = $2 and status is null`,
+		userID, key,
+	)
+	return err
+}
+
+// Purge удаляет просроченные ключи.
+func (st *Store) Purge(ctx context.Context) (int64, error) {
+	tag, err := st.Pool.Exec(ctx, `delete from public.idempotency_keys where expires_at <= now()`)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Middleware
+// POST запрос с заголовком Idempotency-Key выполняется один раз: повтор с тем же ключом
+// получает сохранённый ответ с заголовком Idempotent-Replayed. Ключ принадлежит пользователю
+// и привязан к методу, пути и телу запроса. Ответы 5xx, 401, 403 и 429 не сохраняются:
+// они зависят от заголовков и времени, такой запрос можно повторить. Тело больше maxBody
+// байт отклоняется с 413. Ставится после проверки авторизации и только на ручки, ответ
+// которых не содержит секретов: тело ответа хранится в базе как есть.
+func Middleware(keys Keys, maxBody int64, logger *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(HeaderKey)
+			userID, ok := r.Context().Value(cookie.UserNum(`UserID`)).(int)
+			if r.Method != http.MethodPost || key == `` || !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > MaxKeyLength {
+				http.Error(w, HeaderKey+` header is too long`, http.StatusBadRequest)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					http.Error(w, `request body is too large`, http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, `can not read request body`, http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			stored, err := keys.Begin(r.Context(), userID, key, requestHash(r, body))
+			if err != nil {
+				switch {
+				case errors.Is(err, ErrKeyMismatch):
+					http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				case errors.Is(err, ErrInProgress):
+					http.Error(w, err.Error(), http.StatusConflict)
+				default:
+					logger.Error(err.Error())
+					http.Error(w, `internal error`, http.StatusInternalServerError)
+				}
+				return
+			}
+			if stored != nil {
+				if stored.ContentType != `` {
+					w.Header().Set(`Content-Type`, stored.ContentType)
+				}
+				w.Header().Set(HeaderReplayed, `true`)
+				w.WriteHeader(stored.Status)
+				if _, err = w.Write(stored.Body); err != nil {
+					logger.Error(err.Error())
+				}
+				return
+			}
+
+			rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+			completed := false
+			defer func() {
+				if completed {
+					return
+				}
+				// паника или несохраняемый ответ: ключ освобождаем, контекст запроса мог быть уже отменён
+				if err := keys.Release(context.Background(), userID, key); err != nil {
+					logger.Error(err.Error())
+				}
+			}()
+
+			next.ServeHTTP(rec, r)
+
+			if !storable(rec.status) {
+				return
+			}
+			err = keys.Complete(context.Background(), userID, key, Response{
+				Status:      rec.status,
+				ContentType: w.Header().Get(`Content-Type`),
+				Body:        rec.body.Bytes(),
+			})
+			if err != nil {
+				logger.Error(err.Error())
+				return
+			}
+			completed = true
+		})
+	}
+}
+
+// storable можно ли отдавать ответ повторно. Отказ в доступе и 429 после
+// кода в заголовке или по истечении блокировки сменятся другим ответом.
+func storable(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return false
+	}
+	return status < http.StatusInternalServerError
+}
+
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + ` ` + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recorder пишет ответ клиенту и запоминает его.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,241 @@
+package idempotency
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-diploma/server/cookie"
+	"go-diploma/server/storage/database/databasetest"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testMaxBody = 16
+
+type stored struct {
+	hash     string
+	response *Response
+}
+
+// memoryKeys хранилище в памяти с той же логикой, что и Store.
+type memoryKeys struct {
+	mu   sync.Mutex
+	keys map[string]stored
+}
+
+func newMemoryKeys() *memoryKeys {
+	return &memoryKeys{keys: map[string]stored{}}
+}
+
+func (m *memoryKeys) Begin(_ context.Context, userID int, key, requestHash string) (*Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := fmt.Sprint(userID, `:`, key)
+	s, ok := m.keys[id]
+	if !ok {
+		m.keys[id] = stored{hash: requestHash}
+		return nil, nil
+	}
+	if s.hash != requestHash {
+		return nil, ErrKeyMismatch
+	}
+	if s.response == nil {
+		return nil, ErrInProgress
+	}
+	return s.response, nil
+}
+
+func (m *memoryKeys) Complete(_ context.Context, userID int, key string, r Response) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := fmt.Sprint(userID, `:`, key)
+	m.keys[id] = stored{hash: m.keys[id].hash, response: &r}
+	return nil
+}
+
+func (m *memoryKeys) Release(_ context.Context, userID int, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := fmt.Sprint(userID, `:`, key)
+	if m.keys[id].response == nil {
+		delete(m.keys, id)
+	}
+	return nil
+}
+
+func TestMiddleware(t *testing.T) {
+	keys := newMemoryKeys()
+	calls := 0
+	status := http.StatusOK
+	handler := Middleware(keys, testMaxBody, zap.NewNop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set(`Content-Type`, `application/json`)
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"call":%d,"body":%q}`, calls, body)
+	}))
+
+	send := func(method, key string, userID int, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, `/api/user/balance/withdraw`, strings.NewReader(body))
+		if key != `` {
+			req.Header.Set(HeaderKey, key)
+		}
+		if userID != 0 {
+			req = req.WithContext(context.WithValue(req.Context(), cookie.UserNum(`UserID`), userID))
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		key      string
+		userID   int
+		body     string
+		status   int
+		want     int
+		calls    int
+		replayed bool
+		response string
+	}{
+		{name: `Test first request`, method: http.MethodPost, key: `k1`, userID: 1, body: `a`, want: http.StatusOK, calls: 1, response: `{"call":1,"body":"a"}`},
+		{name: `Test replay`, method: http.MethodPost, key: `k1`, userID: 1, body: `a`, want: http.StatusOK, calls: 1, replayed: true, response: `{"call":1,"body":"a"}`},
+		{name: `Test different body`, method: http.MethodPost, key: `k1`, userID: 1, body: `b`, want: http.StatusUnprocessableEntity, calls: 1},
+		{name: `Test another user`, method: http.MethodPost, key: `k1`, userID: 2, body: `b`, want: http.StatusOK, calls: 2, response: `{"call":2,"body":"b"}`},
+		{name: `Test client error is stored`, method: http.MethodPost, key: `k2`, userID: 1, body: `a`, status: http.StatusPaymentRequired, want: http.StatusPaymentRequired, calls: 3},
+		{name: `Test client error replay`, method: http.MethodPost, key: `k2`, userID: 1, body: `a`, want: http.StatusPaymentRequired, calls: 3, replayed: true},
+		{name: `Test server error`, method: http.MethodPost, key: `k3`, userID: 1, body: `a`, status: http.StatusInternalServerError, want: http.StatusInternalServerError, calls: 4},
+		{name: `Test retry after server error`, method: http.MethodPost, key: `k3`, userID: 1, body: `a`, want: http.StatusOK, calls: 5},
+		{name: `Test without key`, method: http.MethodPost, userID: 1, body: `a`, want: http.StatusOK, calls: 6},
+		{name: `Test not post`, method: http.MethodPut, key: `k1`, userID: 1, body: `c`, want: http.StatusOK, calls: 7},
+		{name: `Test without user`, method: http.MethodPost, key: `k1`, body: `c`, want: http.StatusOK, calls: 8},
+		{name: `Test long key`, method: http.MethodPost, key: strings.Repeat(`k`, MaxKeyLength+1), userID: 1, want: http.StatusBadRequest, calls: 8},
+		{name: `Test body too large`, method: http.MethodPost, key: `k4`, userID: 1, body: strings.Repeat(`a`, testMaxBody+1), want: http.StatusRequestEntityTooLarge, calls: 8},
+		{name: `Test forbidden`, method: http.MethodPost, key: `k5`, userID: 1, body: `a`, status: http.StatusForbidden, want: http.StatusForbidden, calls: 9},
+		{name: `Test retry after forbidden`, method: http.MethodPost, key: `k5`, userID: 1, body: `a`, want: http.StatusOK, calls: 10},
+		{name: `Test too many requests`, method: http.MethodPost, key: `k6`, userID: 1, body: `a`, status: http.StatusTooManyRequests, want: http.StatusTooManyRequests, calls: 11},
+		{name: `Test retry after lock`, method: http.MethodPost, key: `k6`, userID: 1, body: `a`, want: http.StatusOK, calls: 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status = http.StatusOK
+			if tt.status != 0 {
+				status = tt.status
+			}
+			res := send(tt.method, tt.key, tt.userID, tt.body)
+			assert.Equal(t, tt.want, res.Code)
+			assert.Equal(t, tt.calls, calls)
+			if tt.replayed {
+				assert.Equal(t, `true`, res.Header().Get(HeaderReplayed))
+				assert.Equal(t, `application/json`, res.Header().Get(`Content-Type`))
+			} else {
+				assert.Empty(t, res.Header().Get(HeaderReplayed))
+			}
+			if tt.response != `` {
+				assert.Equal(t, tt.response, res.Body.String())
+			}
+		})
+	}
+}
+
+func TestMiddleware_InProgress(t *testing.T) {
+	keys := newMemoryKeys()
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	handler := Middleware(keys, testMaxBody, zap.NewNop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, `/api/user/balance/withdraw`, strings.NewReader(`a`))
+		req.Header.Set(HeaderKey, `k`)
+		req = req.WithContext(context.WithValue(req.Context(), cookie.UserNum(`UserID`), 1))
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- send() }()
+	<-started
+	assert.Equal(t, http.StatusConflict, send().Code)
+	close(finish)
+	assert.Equal(t, http.StatusOK, (<-done).Code)
+}
+
+func testStore(t *testing.T, ttl time.Duration) *Store {
+	var st Store
+	st.Init(databasetest.New(t).Pool, ttl, time.Minute)
+	return &st
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	st := testStore(t, time.Hour)
+	userID := databasetest.UserID()
+	t.Cleanup(func() {
+		st.Pool.Exec(ctx, `delete from public.idempotency_keys where user_id = $1`, userID)
+	})
+
+	r, err := st.Begin(ctx, userID, `k`, `hash`)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	_, err = st.Begin(ctx, userID, `k`, `hash`)
+	assert.ErrorIs(t, err, ErrInProgress)
+	_, err = st.Begin(ctx, userID, `k`, `other`)
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+
+	require.NoError(t, st.Complete(ctx, userID, `k`, Response{Status: 200, ContentType: `application/json`, Body: []byte(`{}`)}))
+	r, err = st.Begin(ctx, userID, `k`, `hash`)
+	require.NoError(t, err)
+	assert.Equal(t, &Response{Status: 200, ContentType: `application/json`, Body: []byte(`{}`)}, r)
+
+	// сохранённый ответ Release не трогает
+	require.NoError(t, st.Release(ctx, userID, `k`))
+	_, err = st.Begin(ctx, userID, `k`, `hash`)
+	require.NoError(t, err)
+
+	// ключ без ответа после Lease занимает только повтор того же запроса
+	_, err = st.Begin(ctx, userID, `crashed`, `hash`)
+	require.NoError(t, err)
+	_, err = st.Pool.Exec(ctx, `update public.idempotency_keys set locked_until = now() - interval '1 second'
+		where user_id = $1 and key = 'crashed'`, userID)
+	require.NoError(t, err)
+	_, err = st.Begin(ctx, userID, `crashed`, `other`)
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+	r, err = st.Begin(ctx, userID, `crashed`, `hash`)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+	_, err = st.Begin(ctx, userID, `crashed`, `hash`)
+	assert.ErrorIs(t, err, ErrInProgress)
+
+	// просроченный ключ занимается заново и удаляется Purge
+	_, err = st.Begin(ctx, userID, `expired`, `hash`)
+	require.NoError(t, err)
+	_, err = st.Pool.Exec(ctx, `update public.idempotency_keys set expires_at = now() - interval '1 second'
+		where user_id = $1 and key = 'expired'`, userID)
+	require.NoError(t, err)
+	r, err = st.Begin(ctx, userID, `expired`, `other`)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	_, err = st.Pool.Exec(ctx, `update public.idempotency_keys set expires_at = now() - interval '1 second'
+		where user_id = $1`, userID)
+	require.NoError(t, err)
+	purged, err := st.Purge(ctx)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, purged, int64(3))
+}
@@ -0,0 +1,240 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go-diploma/internal/utils/money"
+	"time"
+)
+
+// Виды записей журнала.
+const (
+	KindAccrual    = `accrual`
+	KindWithdrawal = `withdrawal`
+	KindAdjustment = `adjustment`
+	KindReversal   = `reversal`
+)
+
+const (
+	DefaultLimit = 50
+	MaxLimit     = 200
+)
+
+var (
+	ErrNotFound        = errors.New(`ledger entry not found`)
+	ErrAlreadyReversed = errors.New(`ledger entry is already reversed`)
+	ErrNotReversible   = errors.New(`reversal can not be reversed`)
+	ErrZeroAmount      = errors.New(`adjustment amount must not be zero`)
+	ErrNegativeBalance = errors.New(`balance can not become negative`)
+)
+
+// BalanceConstraint ограничение accruals, которое не даёт балансу уйти в минус.
+const BalanceConstraint = `accruals_balance_non_negative`
+
+// Entry запись журнала баллов. Amount со знаком: начисление положительное,
+// списание отрицательное. Записи не меняются и не удаляются - ошибка
+// исправляется отменой (reversal) или корректировкой (adjustment).
+type Entry struct {
+	ID           int64        `json:"id"`
+	UserID       int          `json:"-"`
+	Kind         string       `json:"kind"`
+	Amount       money.Amount `json:"amount"`
+	OrderID      *int         `json:"-"`
+	Order        string       `json:"order,omitempty"`
+	WithdrawalID *int         `json:"withdrawal_id,omitempty"`
+	ReversesID   *int64       `json:"reverses_id,omitempty"`
+	Comment      string       `json:"comment,omitempty"`
+	CreatedAt    time.Time    `json:"created_at"`
+}
+
+// Mismatch пользователь, у которого баланс в accruals не сходится с журналом.
+type Mismatch struct {
+	UserID           int          `json:"user_id"`
+	Balance          money.Amount `json:"balance"`
+	LedgerBalance    money.Amount `json:"ledger_balance"`
+	Withdrawn        money.Amount `json:"withdrawn"`
+	LedgerWithdrawn  money.Amount `json:"ledger_withdrawn"`
+	BalanceDelta     money.Amount `json:"balance_delta"`
+	WithdrawnDelta   money.Amount `json:"withdrawn_delta"`
+	HasProjectionRow bool         `json:"has_projection_row"`
+}
+
+// Ledger журнал движения баллов. Баланс и сумма списаний в accruals -
+// проекция журнала, её ведёт триггер при добавлении записи.
+type Ledger struct {
+	Pool *pgxpool.Pool
+}
+
+func (l *Ledger) Init(pool *pgxpool.Pool) {
+	l.Pool = pool
+}
+
+// Append
+// Добавляет запись в транзакции вызывающего: движение баллов фиксируется
+// вместе с заказом или списанием, к которому относится.
+func Append(ctx context.Context, tx pgx.Tx, e Entry) (int64, error) {
+	var id int64
+	err := tx.QueryRow(
+		ctx,
+		`insert into public.ledger_entries (user_id, kind, amount, order_id, withdrawal_id, reverses_id, comment)
+			values ($1, $2, $3, $4, $5, $6, $7)
+			returning id`,
+		e.UserID, e.Kind, e.Amount, e.OrderID, e.WithdrawalID, e.ReversesID, e.Comment,
+	).Scan(&id)
+	return id, err
+}
+
+// Adjust ручная корректировка баланса, comment обязателен для разбора.
+func (l *Ledger) Adjust(ctx context.Context, userID int, amount money.Amount, comment string) (int64, error) {
+	if amount == 0 {
+		return 0, ErrZeroAmount
+	}
+	tx, err := l.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	id, err := Append(ctx, tx, Entry{UserID: userID, Kind: KindAdjustment, Amount: amount, Comment: comment})
+	if err != nil {
+		if violates(err, BalanceConstraint) {
+			return 0, ErrNegativeBalance
+		}
+		return 0, err
+	}
+	return id, tx.Commit(ctx)
+}
+
+// Reverse
+// Отменяет запись встречной записью на ту же сумму с обратным знаком.
+func (l *Ledger) Reverse(ctx context.Context, entryID int64, comment string) (Entry, error) {
+	tx, err := l.Pool.Begin(ctx)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var original Entry
+	err = tx.QueryRow(
+		ctx,
+		`select id, user_id, kind, amount from public.ledger_entries where id = $1`,
+		entryID,
+	).Scan(&original.ID, &original.UserID, &original.Kind, &original.Amount)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Entry{}, ErrNotFound
+		}
+		return Entry{}, err
+	}
+	if original.Kind == KindReversal {
+		return Entry{}, ErrNotReversible
+	}
+
+	reversal := Entry{
+		UserID:     original.UserID,
+		Kind:       KindReversal,
+		Amount:     -original.Amount,
+		ReversesID: &original.ID,
+		Comment:    comment,
+	}
+	reversal.ID, err = Append(ctx, tx, reversal)
+	if err != nil {
+		if violates(err, `unique_ledger_reversal`) {
+			return Entry{}, ErrAlreadyReversed
+		}
+		if violates(err, BalanceConstraint) {
+			return Entry{}, ErrNegativeBalance
+		}
+		return Entry{}, err
+	}
+	return reversal, tx.Commit(ctx)
+}
+
+// History
+// Записи пользователя от новых к старым, beforeID - курсор страницы.
+func (l *Ledger) History(ctx context.Context, userID int, beforeID int64, limit int) ([]Entry, error) {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	rows, err := l.Pool.Query(
+		ctx,
+		`select ledger_entries.id, ledger_entries.user_id, kind, amount,
+					order_id, coalesce(orders.number, ''), withdrawal_id, reverses_id, comment, created_at
+			from public.ledger_entries
+			left join public.orders on orders.id = ledger_entries.order_id
+			where ledger_entries.user_id = $1 and ($2::bigint = 0 or ledger_entries.id < $2)
+			order by ledger_entries.id desc
+			limit $3`,
+		userID, beforeID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]Entry, 0)
+	for rows.Next() {
+		var e Entry
+		err = rows.Scan(&e.ID, &e.UserID, &e.Kind, &e.Amount, &e.OrderID, &e.Order,
+			&e.WithdrawalID, &e.ReversesID, &e.Comment, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Reconcile
+// Сверка проекции accruals с журналом. Пустой ответ - всё сходится.
+func (l *Ledger) Reconcile(ctx context.Context) ([]Mismatch, error) {
+	rows, err := l.Pool.Query(
+		ctx,
+		`with journal as (
+				select e.user_id,
+					sum(e.amount) as balance,
+					sum(case when e.kind = 'withdrawal' or reversed.kind = 'withdrawal' then -e.amount else 0 end) as withdrawn
+				from public.ledger_entries e
+				left join public.ledger_entries reversed on reversed.id = e.reverses_id
+				group by e.user_id
+			)
+			select coalesce(accruals.user_id, journal.user_id),
+				coalesce(accruals.current_balance, 0), coalesce(journal.balance, 0),
+				coalesce(accruals.total_withdrawn, 0), coalesce(journal.withdrawn, 0),
+				accruals.user_id is not null
+			from public.accruals
+			full join journal on journal.user_id = accruals.user_id
+			where coalesce(accruals.current_balance, 0) <> coalesce(journal.balance, 0)
+				or coalesce(accruals.total_withdrawn, 0) <> coalesce(journal.withdrawn, 0)
+			order by 1`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mismatches := make([]Mismatch, 0)
+	for rows.Next() {
+		var m Mismatch
+		err = rows.Scan(&m.UserID, &m.Balance, &m.LedgerBalance, &m.Withdrawn, &m.LedgerWithdrawn, &m.HasProjectionRow)
+		if err != nil {
+			return nil, err
+		}
+		m.BalanceDelta = m.Balance - m.LedgerBalance
+		m.WithdrawnDelta = m.Withdrawn - m.LedgerWithdrawn
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, rows.Err()
+}
+
+// violates ошибка базы из-за ограничения constraint.
+func violates(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.ConstraintName == constraint
+}
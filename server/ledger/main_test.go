@@ -0,0 +1,136 @@
+package ledger
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-diploma/internal/utils/money"
+	"go-diploma/server/storage/database/databasetest"
+	"testing"
+)
+
+// testLedger журнал на тестовой базе из TEST_DATABASE_URI, без базы тест пропускается.
+func testLedger(t *testing.T) *Ledger {
+	var l Ledger
+	l.Init(databasetest.New(t).Pool)
+	return &l
+}
+
+func TestLedger_AdjustAndReverse(t *testing.T) {
+	l := testLedger(t)
+	ctx := context.Background()
+	userID := databasetest.UserID()
+
+	balance := func() (money.Amount, money.Amount) {
+		var current, withdrawn money.Amount
+		err := l.Pool.QueryRow(
+			ctx,
+			`select current_balance, total_withdrawn from public.accruals where user_id = $1`,
+			userID,
+		).Scan(&current, &withdrawn)
+		require.NoError(t, err)
+		return current, withdrawn
+	}
+
+	creditID, err := l.Adjust(ctx, userID, 70000, `welcome bonus`)
+	require.NoError(t, err)
+	_, err = l.Adjust(ctx, userID, -20001, `support correction`)
+	require.NoError(t, err)
+	current, withdrawn := balance()
+	assert.Equal(t, money.Amount(49999), current)
+	assert.Equal(t, money.Amount(0), withdrawn)
+
+	// отмена бонуса увела бы баланс в минус
+	_, err = l.Reverse(ctx, creditID, `bonus granted by mistake`)
+	assert.ErrorIs(t, err, ErrNegativeBalance)
+	_, err = l.Adjust(ctx, userID, -50000, `overdraft`)
+	assert.ErrorIs(t, err, ErrNegativeBalance)
+
+	_, err = l.Adjust(ctx, userID, 20001, `top up before reversal`)
+	require.NoError(t, err)
+	reversal, err := l.Reverse(ctx, creditID, `bonus granted by mistake`)
+	require.NoError(t, err)
+	assert.Equal(t, money.Amount(-70000), reversal.Amount)
+	current, _ = balance()
+	assert.Equal(t, money.Amount(0), current)
+
+	_, err = l.Reverse(ctx, creditID, `again`)
+	assert.ErrorIs(t, err, ErrAlreadyReversed)
+	_, err = l.Reverse(ctx, reversal.ID, `undo`)
+	assert.ErrorIs(t, err, ErrNotReversible)
+	_, err = l.Reverse(ctx, -1, `missing`)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = l.Adjust(ctx, userID, 0, `nothing`)
+	assert.ErrorIs(t, err, ErrZeroAmount)
+
+	_, err = l.Pool.Exec(ctx, `update public.ledger_entries set amount = 1 where id = $1`, creditID)
+	assert.Error(t, err, `ledger must be append-only`)
+
+	history, err := l.History(ctx, userID, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, history, 4)
+	assert.Equal(t, KindReversal, history[0].Kind)
+
+	mismatches, err := l.Reconcile(ctx)
+	require.NoError(t, err)
+	for _, m := range mismatches {
+		assert.NotEqual(t, userID, m.UserID)
+	}
+}
+
+// Данные, накопленные в float до перехода на numeric, сходятся с журналом: разница
+// округления записана корректировкой, баланс не изменился, сумма списаний пересчитана.
+func TestMigration_MoneyNumericReconciles(t *testing.T) {
+	db := databasetest.Fresh(t)
+	ctx := context.Background()
+	require.NoError(t, db.Migrate(16))
+
+	// у первого начисления по 0.006 - в копейках 0.01 каждое, баланс 0.018 - 0.02;
+	// у второго списания по 0.005 - в копейках 0.01 каждое, всего списано 0.01
+	_, err := db.Pool.Exec(ctx, `insert into public.orders (user_id, number, status, accrual) values
+		(1, '1001', 'PROCESSED', 0.006), (1, '1002', 'PROCESSED', 0.006), (1, '1003', 'PROCESSED', 0.006),
+		(2, '2001', 'PROCESSED', 1)`)
+	require.NoError(t, err)
+	_, err = db.Pool.Exec(ctx, `insert into public.order_credits (order_id, user_id, amount)
+		select id, user_id, accrual from public.orders`)
+	require.NoError(t, err)
+	_, err = db.Pool.Exec(ctx, `insert into public.withdrawals (user_id, order_number, sum) values
+		(2, '2002', 0.005), (2, '2003', 0.005)`)
+	require.NoError(t, err)
+	_, err = db.Pool.Exec(ctx, `insert into public.accruals (user_id, current_balance, total_withdrawn) values
+		(1, 0.018, 0), (2, 0.99, 0.01)`)
+	require.NoError(t, err)
+
+	require.NoError(t, db.PrepareDB())
+
+	var l Ledger
+	l.Init(db.Pool)
+	mismatches, err := l.Reconcile(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	tests := []struct {
+		userID     int
+		balance    money.Amount
+		withdrawn  money.Amount
+		adjustment money.Amount
+	}{
+		{userID: 1, balance: 2, withdrawn: 0, adjustment: -1},
+		{userID: 2, balance: 99, withdrawn: 2, adjustment: 1},
+	}
+	for _, tt := range tests {
+		var balance, withdrawn, adjustment money.Amount
+		err = db.Pool.QueryRow(
+			ctx,
+			`select current_balance, total_withdrawn,
+					(select sum(amount) from public.ledger_entries
+						where user_id = $1 and comment = 'rounding difference after numeric conversion')
+				from public.accruals where user_id = $1`,
+			tt.userID,
+		).Scan(&balance, &withdrawn, &adjustment)
+		require.NoError(t, err)
+		assert.Equal(t, tt.balance, balance)
+		assert.Equal(t, tt.withdrawn, withdrawn)
+		assert.Equal(t, tt.adjustment, adjustment)
+	}
+}
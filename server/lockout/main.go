@@ -0,0 +1,173 @@
+package lockout
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	loginPrefix          = `login:`
+	ipPrefix             = `ip:`
+	passwordChangePrefix = `password-change:`
+)
+
+// Policy сколько неудачных попыток прощается и как растёт блокировка после них.
+type Policy struct {
+	LoginAttempts int
+	IPAttempts    int
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	// ResetAfter - через сколько после последней ошибки счётчик начинается заново.
+	ResetAfter time.Duration
+}
+
+// Guard ведёт счётчики неудачных входов по логину и по IP клиента.
+// Логин учитывается независимо от того, существует ли такой пользователь.
+type Guard struct {
+	Pool   *pgxpool.Pool
+	Policy Policy
+}
+
+func (g *Guard) Init(pool *pgxpool.Pool, p Policy) {
+	g.Pool = pool
+	g.Policy = p
+}
+
+func LoginKey(login string) string {
+	return loginPrefix + login
+}
+
+func IPKey(ip string) string {
+	return ipPrefix + ip
+}
+
+// PasswordChangeKey
+// Подтверждение действий текущим паролем считается отдельно от входа: владелец
+// украденной сессии не должен блокировать настоящему владельцу вход.
+func PasswordChangeKey(userID int) string {
+	return passwordChangePrefix + strconv.Itoa(userID)
+}
+
+// Attempt
+// Учитывает попытку до проверки пароля или кода: параллельные попытки не проходят
+// мимо лимита, пока медленная проверка ещё идёт. Если ключ уже заблокирован,
+// попытка не учитывается и возвращается, сколько ждать до снятия самой долгой блокировки.
+// Удачную попытку нужно вернуть через Reset или Refund.
+func (g *Guard) Attempt(ctx context.Context, keys ...string) (time.Duration, error) {
+	tx, err := g.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// строки блокируются в одном порядке, иначе параллельные попытки ждали бы друг друга
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	failures := make([]int, len(sorted))
+	var wait time.Duration
+	for i, key := range sorted {
+		var expired bool
+		var locked float64
+		err = tx.QueryRow(
+			ctx,
+			`insert into public.login_attempts (key, failures, last_failure_at)
+				values ($1, 0, now())
+				on conflict (key) do update set key = excluded.key
+				returning failures, last_failure_at < now() - $2::interval,
+					coalesce(extract(epoch from locked_until - now()), 0)::float8`,
+			key, g.Policy.ResetAfter,
+		).Scan(&failures[i], &expired, &locked)
+		if err != nil {
+			return 0, err
+		}
+		if left := time.Duration(locked * float64(time.Second)); left > wait {
+			wait = left
+		}
+		if expired {
+			failures[i] = 0
+		}
+		failures[i]++
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	for i, key := range sorted {
+		delay := g.Policy.Delay(failures[i], g.Policy.attemptsFor(key))
+		_, err = tx.Exec(
+			ctx,
+			`update public.login_attempts set failures = $2, last_failure_at = now(),
+				locked_until = case when $3::interval > interval '0' then now() + $3::interval end
+				where key = $1`,
+			key, failures[i], delay,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, tx.Commit(ctx)
+}
+
+// Refund
+// Возвращает удачную попытку, учтённую Attempt, не сбрасывая остальные ошибки.
+// Блокировка снимается, если без этой попытки лимит не превышен.
+func (g *Guard) Refund(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		_, err := g.Pool.Exec(
+			ctx,
+			`update public.login_attempts set failures = greatest(failures - 1, 0),
+				locked_until = case when failures - 1 > $2 then locked_until end
+				where key = $1`,
+			key, g.Policy.attemptsFor(key),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset
+// Сбрасывает счётчики после успешного входа.
+func (g *Guard) Reset(ctx context.Context, keys ...string) error {
+	_, err := g.Pool.Exec(ctx, `delete from public.login_attempts where key = any($1)`, keys)
+	return err
+}
+
+// Unlock
+// Снимает блокировку с логина вручную (администратор).
+func (g *Guard) Unlock(ctx context.Context, login string) error {
+	return g.Reset(ctx, LoginKey(login))
+}
+
+// Delay
+// Экспоненциальная задержка: после attempts бесплатных ошибок
+// каждая следующая удваивает блокировку, но не больше MaxDelay.
+func (p Policy) Delay(failures int, attempts int) time.Duration {
+	over := failures - attempts
+	if over <= 0 {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := 1; i < over; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	if delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+func (p Policy) attemptsFor(key string) int {
+	if strings.HasPrefix(key, ipPrefix) {
+		return p.IPAttempts
+	}
+	return p.LoginAttempts
+}
@@ -0,0 +1,106 @@
+package lockout
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-diploma/server/storage/database/databasetest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPolicy_Delay(t *testing.T) {
+	p := Policy{
+		LoginAttempts: 3,
+		IPAttempts:    10,
+		BaseDelay:     time.Second,
+		MaxDelay:      10 * time.Second,
+	}
+
+	tests := []struct {
+		name     string
+		failures int
+		attempts int
+		want     time.Duration
+	}{
+		{name: `Test free attempts`, failures: 3, attempts: 3, want: 0},
+		{name: `Test first lock`, failures: 4, attempts: 3, want: time.Second},
+		{name: `Test doubling`, failures: 6, attempts: 3, want: 4 * time.Second},
+		{name: `Test max delay`, failures: 30, attempts: 3, want: 10 * time.Second},
+		{name: `Test ip attempts`, failures: 6, attempts: p.attemptsFor(IPKey(`127.0.0.1`)), want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, p.Delay(tt.failures, tt.attempts))
+		})
+	}
+	assert.Equal(t, 3, p.attemptsFor(LoginKey(`user`)))
+	assert.Equal(t, 3, p.attemptsFor(PasswordChangeKey(1)))
+	assert.NotEqual(t, LoginKey(`1`), PasswordChangeKey(1))
+}
+
+// Параллельные попытки учитываются до проверки пароля: пройти могут только
+// бесплатные попытки и одна, после которой наступает блокировка.
+func TestGuard_AttemptConcurrent(t *testing.T) {
+	var g Guard
+	g.Init(databasetest.New(t).Pool, Policy{
+		LoginAttempts: 3,
+		IPAttempts:    10,
+		BaseDelay:     time.Minute,
+		MaxDelay:      time.Hour,
+		ResetAfter:    time.Hour,
+	})
+	ctx := context.Background()
+	key := LoginKey(`lockout-` + strconv.Itoa(databasetest.UserID()))
+	t.Cleanup(func() {
+		g.Reset(ctx, key)
+	})
+
+	const attempts = 20
+	type result struct {
+		wait time.Duration
+		err  error
+	}
+	results := make(chan result, attempts)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			wait, err := g.Attempt(ctx, key)
+			results <- result{wait: wait, err: err}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+
+	allowed := 0
+	for r := range results {
+		require.NoError(t, r.err)
+		if r.wait == 0 {
+			allowed++
+		}
+	}
+	assert.Equal(t, 4, allowed)
+
+	// удачная попытка возвращается, блокировка от неё снимается
+	require.NoError(t, g.Reset(ctx, key))
+	for i := 0; i < 4; i++ {
+		wait, err := g.Attempt(ctx, key)
+		require.NoError(t, err)
+		require.Zero(t, wait)
+	}
+	require.NoError(t, g.Refund(ctx, key))
+	wait, err := g.Attempt(ctx, key)
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+	wait, err = g.Attempt(ctx, key)
+	require.NoError(t, err)
+	assert.Greater(t, wait, time.Duration(0))
+}
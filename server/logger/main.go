@@ -6,13 +6,16 @@ import (
 	"os"
 )
 
+// Level уровень логирования, меняется на лету через управляющий интерфейс.
+var Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+
 func CreateLogger() *zap.Logger {
 	encoderCfg := zap.NewProductionEncoderConfig()
 	encoderCfg.TimeKey = "timestamp"
 	encoderCfg.EncodeTime = zapcore.RFC3339NanoTimeEncoder
 
 	config := zap.Config{
-		Level:             zap.NewAtomicLevelAt(zap.InfoLevel),
+		Level:             Level,
 		Development:       true,
 		DisableCaller:     false,
 		DisableStacktrace: true,
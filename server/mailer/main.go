@@ -0,0 +1,151 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-diploma/server/config"
+	"go.uber.org/zap"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Драйверы отправки почты.
+const (
+	DriverSMTP = `smtp`
+	DriverFile = `file`
+	DriverLog  = `log`
+)
+
+var (
+	ErrUnknownDriver = errors.New(`unknown mail driver`)
+	ErrNoRecipient   = errors.New(`mail recipient is empty`)
+	ErrHeaderBreak   = errors.New(`mail header contains line break`)
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer отправка писем пользователям.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New выбирает реализацию по MAIL_DRIVER.
+func New(c config.MailCfg, l *zap.Logger) (Mailer, error) {
+	switch c.Driver {
+	case DriverSMTP:
+		return &SMTP{Addr: c.SMTPAddress, From: c.From, Username: c.SMTPUsername, Password: c.SMTPPassword}, nil
+	case DriverFile:
+		return &File{Dir: c.Dir, From: c.From}, nil
+	case DriverLog, ``:
+		return &Log{Logger: l}, nil
+	default:
+		return nil, fmt.Errorf(c.Driver+`: %w`, ErrUnknownDriver)
+	}
+}
+
+// compose письмо в формате RFC 5322 с телом в UTF-8.
+func compose(from string, msg Message) ([]byte, error) {
+	if msg.To == `` {
+		return nil, ErrNoRecipient
+	}
+	// перевод строки в адресе или теме позволил бы дописать свои заголовки
+	if strings.ContainsAny(msg.To+msg.Subject+from, "\r\n") {
+		return nil, ErrHeaderBreak
+	}
+	var b strings.Builder
+	b.WriteString(`From: ` + from + "\r\n")
+	b.WriteString(`To: ` + msg.To + "\r\n")
+	b.WriteString(`Subject: ` + mime.BEncoding.Encode(`UTF-8`, msg.Subject) + "\r\n")
+	b.WriteString(`Date: ` + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
+
+/**
+ * SMTP
+ */
+
+// SMTP отправка через почтовый сервер. STARTTLS включается, если сервер его
+// поддерживает, авторизация - только при заданном Username.
+type SMTP struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (m *SMTP) Send(_ context.Context, msg Message) error {
+	body, err := compose(m.From, msg)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != `` {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth(``, m.Username, m.Password, host)
+	}
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, auth, from.Address, []string{msg.To}, body)
+}
+
+/**
+ * File - письма складываются в каталог, для тестов и локальной разработки.
+ */
+
+type File struct {
+	Dir     string
+	From    string
+	counter atomic.Int64
+}
+
+func (m *File) Send(_ context.Context, msg Message) error {
+	body, err := compose(m.From, msg)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(m.Dir, 0o700); err != nil {
+		return err
+	}
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + `-` + strconv.FormatInt(m.counter.Add(1), 10) + `.eml`
+	return os.WriteFile(filepath.Join(m.Dir, name), body, 0o600)
+}
+
+/**
+ * Log - в лог пишутся только адрес, тема и размер письма. Тело не пишется:
+ * в нём токены сброса пароля. Чтобы прочитать письмо, нужен драйвер file.
+ */
+
+type Log struct {
+	Logger *zap.Logger
+}
+
+func (m *Log) Send(_ context.Context, msg Message) error {
+	if msg.To == `` {
+		return ErrNoRecipient
+	}
+	m.Logger.Info(`mail`, zap.String(`to`, msg.To), zap.String(`subject`, msg.Subject), zap.Int(`body_size`, len(msg.Body)))
+	return nil
+}
@@ -0,0 +1,106 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-diploma/server/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver string
+		want   Mailer
+		err    error
+	}{
+		{name: `Test default driver`, driver: ``, want: &Log{}},
+		{name: `Test file driver`, driver: DriverFile, want: &File{}},
+		{name: `Test smtp driver`, driver: DriverSMTP, want: &SMTP{}},
+		{name: `Test unknown driver`, driver: `pigeon`, err: ErrUnknownDriver},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(config.MailCfg{Driver: tt.driver}, zap.NewNop())
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.IsType(t, tt.want, m)
+		})
+	}
+}
+
+func TestFile_Send(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), `mail`)
+	m := &File{Dir: dir, From: `Gophermart <noreply@gophermart.local>`}
+
+	err := m.Send(context.Background(), Message{
+		To:      `alice@example.com`,
+		Subject: `Восстановление пароля`,
+		Body:    "line one\nline two",
+	})
+	require.NoError(t, err)
+	err = m.Send(context.Background(), Message{To: `bob@example.com`, Subject: `Hello`, Body: `hi`})
+	require.NoError(t, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, `*.eml`))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	var contents []string
+	for _, f := range files {
+		raw, err := os.ReadFile(f)
+		require.NoError(t, err)
+		contents = append(contents, string(raw))
+	}
+	all := strings.Join(contents, "\n")
+	assert.Contains(t, all, "To: alice@example.com\r\n")
+	assert.Contains(t, all, "Subject: =?UTF-8?b?")
+	assert.Contains(t, all, "\r\n\r\nline one\r\nline two")
+	assert.Contains(t, all, "Subject: Hello\r\n")
+}
+
+func TestCompose_HeaderInjection(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		err  error
+	}{
+		{name: `Test line break in recipient`, msg: Message{To: "a@example.com\r\nBcc: x@example.com"}, err: ErrHeaderBreak},
+		{name: `Test line break in subject`, msg: Message{To: `a@example.com`, Subject: "Hi\nBcc: x@example.com"}, err: ErrHeaderBreak},
+		{name: `Test no recipient`, msg: Message{Subject: `Hi`}, err: ErrNoRecipient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compose(`noreply@gophermart.local`, tt.msg)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestLog_Send(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	m := &Log{Logger: zap.New(core)}
+
+	err := m.Send(context.Background(), Message{To: `alice@example.com`, Subject: `Reset`, Body: `token secret-token`})
+	require.NoError(t, err)
+	require.Equal(t, 1, logs.Len())
+	fields := logs.All()[0].ContextMap()
+	assert.Equal(t, `alice@example.com`, fields[`to`])
+	for _, v := range fields {
+		assert.NotContains(t, fmt.Sprint(v), `secret-token`)
+	}
+
+	assert.ErrorIs(t, m.Send(context.Background(), Message{Subject: `Reset`}), ErrNoRecipient)
+}
@@ -0,0 +1,150 @@
+package passwordreset
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New(`password reset token is invalid or expired`)
+	ErrTooFrequent  = errors.New(`password reset was requested recently`)
+)
+
+// MinInterval чаще писем пользователю не отправляем, чтобы ручку нельзя было
+// использовать для рассылки.
+const MinInterval = time.Minute
+
+// Store одноразовые токены сброса пароля. Хранится только хэш токена.
+type Store struct {
+	Pool *pgxpool.Pool
+	TTL  time.Duration
+}
+
+func (st *Store) Init(pool *pgxpool.Pool, ttl time.Duration) {
+	st.Pool = pool
+	st.TTL = ttl
+}
+
+// Issue
+// Выпускает токен. Ранее выданные и не использованные токены пользователя
+// перестают действовать: действует только последнее письмо.
+func (st *Store) Issue(ctx context.Context, userID int) (string, error) {
+	token, tokenHash, err := newToken()
+	if err != nil {
+		return ``, err
+	}
+
+	tx, err := st.Pool.Begin(ctx)
+	if err != nil {
+		return ``, err
+	}
+	defer tx.Rollback(ctx)
+
+	var recent bool
+	err = tx.QueryRow(
+		ctx,
+		`select exists(
+				select 1 from public.password_resets
+				where user_id = $1 and created_at > now() - $2::interval
+			)`,
+		userID, MinInterval,
+	).Scan(&recent)
+	if err != nil {
+		return ``, err
+	}
+	if recent {
+		return ``, ErrTooFrequent
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`update public.password_resets set used_at = now() where user_id = $1 and used_at is null`,
+		userID,
+	)
+	if err != nil {
+		return ``, err
+	}
+	_, err = tx.Exec(
+		ctx,
+		`insert into public.password_resets (user_id, token_hash, expires_at)
+			values ($1, $2, now() + $3::interval)`,
+		userID, tokenHash, st.TTL,
+	)
+	if err != nil {
+		return ``, err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return ``, err
+	}
+	return token, nil
+}
+
+// Lookup
+// Пользователь действующего токена. Токен при этом не расходуется:
+// пароль проверяется политикой до сброса.
+func (st *Store) Lookup(ctx context.Context, token string) (int, string, error) {
+	var userID int
+	var login string
+	err := st.Pool.QueryRow(
+		ctx,
+		`select users.id, users.login
+			from public.password_resets join public.users on users.id = password_resets.user_id
+			where token_hash = $1 and used_at is null and expires_at > now()`,
+		hashToken(token),
+	).Scan(&userID, &login)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ``, ErrInvalidToken
+		}
+		return 0, ``, err
+	}
+	return userID, login, nil
+}
+
+// Reset
+// Расходует токен и меняет хэш пароля одним запросом: один токен
+// не может сработать дважды, даже если запросы пришли одновременно.
+func (st *Store) Reset(ctx context.Context, token string, passwordHash string) (int, error) {
+	var userID int
+	err := st.Pool.QueryRow(
+		ctx,
+		`with used as (
+				update public.password_resets set used_at = now()
+				where token_hash = $1 and used_at is null and expires_at > now()
+				returning user_id
+			)
+			update public.users set password_hash = $2
+			from used
+			where users.id = used.user_id
+			returning users.id`,
+		hashToken(token), passwordHash,
+	).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrInvalidToken
+		}
+		return 0, err
+	}
+	return userID, nil
+}
+
+func newToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return ``, ``, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,146 @@
+package passwordreset
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-diploma/server/storage/database/databasetest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStore токены на тестовой базе из TEST_DATABASE_URI и новый пользователь для них.
+func testStore(t *testing.T) (*Store, int) {
+	var st Store
+	st.Init(databasetest.New(t).Pool, 30*time.Minute)
+	ctx := context.Background()
+
+	var userID int
+	err := st.Pool.QueryRow(
+		ctx,
+		`insert into public.users (login, password_hash) values ($1, 'old-hash') returning id`,
+		`reset-`+strconv.FormatInt(time.Now().UnixNano(), 10),
+	).Scan(&userID)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		st.Pool.Exec(ctx, `delete from public.password_resets where user_id = $1`, userID)
+		st.Pool.Exec(ctx, `delete from public.users where id = $1`, userID)
+	})
+	return &st, userID
+}
+
+// backdate делает последний запрос сброса старше MinInterval.
+func backdate(t *testing.T, st *Store, userID int) {
+	_, err := st.Pool.Exec(
+		context.Background(),
+		`update public.password_resets set created_at = created_at - $2::interval where user_id = $1`,
+		userID, 2*MinInterval,
+	)
+	require.NoError(t, err)
+}
+
+func TestStore_SingleUse(t *testing.T) {
+	st, userID := testStore(t)
+	ctx := context.Background()
+
+	token, err := st.Issue(ctx, userID)
+	require.NoError(t, err)
+	found, _, err := st.Lookup(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, userID, found)
+
+	reset, err := st.Reset(ctx, token, `new-hash`)
+	require.NoError(t, err)
+	assert.Equal(t, userID, reset)
+	var hash string
+	require.NoError(t, st.Pool.QueryRow(ctx, `select password_hash from public.users where id = $1`, userID).Scan(&hash))
+	assert.Equal(t, `new-hash`, hash)
+
+	_, err = st.Reset(ctx, token, `another-hash`)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, _, err = st.Lookup(ctx, token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = st.Reset(ctx, `unknown`, `another-hash`)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestStore_ConcurrentReset(t *testing.T) {
+	st, userID := testStore(t)
+	ctx := context.Background()
+
+	token, err := st.Issue(ctx, userID)
+	require.NoError(t, err)
+
+	const resets = 10
+	errs := make(chan error, resets)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < resets; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, err := st.Reset(ctx, token, `hash-`+strconv.Itoa(i))
+			errs <- err
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	}
+	assert.Equal(t, 1, succeeded)
+}
+
+func TestStore_Expired(t *testing.T) {
+	st, userID := testStore(t)
+	ctx := context.Background()
+
+	token, err := st.Issue(ctx, userID)
+	require.NoError(t, err)
+	_, err = st.Pool.Exec(
+		ctx,
+		`update public.password_resets set expires_at = now() - interval '1 second' where user_id = $1`,
+		userID,
+	)
+	require.NoError(t, err)
+
+	_, _, err = st.Lookup(ctx, token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = st.Reset(ctx, token, `new-hash`)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestStore_IssueInvalidatesOlder(t *testing.T) {
+	st, userID := testStore(t)
+	ctx := context.Background()
+
+	first, err := st.Issue(ctx, userID)
+	require.NoError(t, err)
+
+	// второе письмо раньше MinInterval не отправляется, первый токен действует
+	_, err = st.Issue(ctx, userID)
+	assert.ErrorIs(t, err, ErrTooFrequent)
+	_, _, err = st.Lookup(ctx, first)
+	require.NoError(t, err)
+
+	backdate(t, st, userID)
+	second, err := st.Issue(ctx, userID)
+	require.NoError(t, err)
+
+	_, _, err = st.Lookup(ctx, first)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = st.Reset(ctx, first, `new-hash`)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = st.Reset(ctx, second, `new-hash`)
+	assert.NoError(t, err)
+}
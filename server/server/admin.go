@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"go-diploma/internal/utils/loginpolicy"
+	"go-diploma/server/apikey"
+	"go-diploma/server/cookie"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ErrUnknownRole = errors.New(`unknown role`)
+
+func validRole(role string) bool {
+	return role == cookie.RoleUser || role == cookie.RoleOperator || role == cookie.RoleAdmin
+}
+
+// CreateAdmin
+// Заводит администратора (команда -command=create-admin).
+// Если логин уже есть, пользователь получает роль admin, пароль не меняется.
+func (s *Server) CreateAdmin(ctx context.Context, login string, password string) error {
+	login = loginpolicy.Normalize(login)
+	tag, err := s.DB.Pool.Exec(
+		ctx,
+		`update public.users set role = $1 where login = $2`,
+		cookie.RoleAdmin, login,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		s.Logger.Info(`existing user promoted to admin: ` + login)
+		return nil
+	}
+
+	violations := s.LoginPolicy.Validate(`login`, login)
+	violations = append(violations, s.PasswordPolicy.Validate(`password`, password, login)...)
+	if len(violations) > 0 {
+		return errors.New(violations[0].Field + ` ` + violations[0].Message)
+	}
+	pwdHash, err := s.Passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+	_, err = s.createUser(ctx, login, ``, pwdHash, cookie.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	s.Logger.Info(`admin created: ` + login)
+	return nil
+}
+
+// AdminUnlockLogin
+// Снятие блокировки входа с логина
+func (s *Server) AdminUnlockLogin(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	login := chi.URLParam(req, `login`)
+	err := s.UnlockLogin(req.Context(), login)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	s.Logger.Info(`login unlocked by admin: ` + login)
+	res.WriteHeader(http.StatusOK)
+}
+
+type RoleChange struct {
+	Role string `json:"role"`
+}
+
+// AdminSetRole
+// Назначение роли пользователю
+func (s *Server) AdminSetRole(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	adminID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+
+	userID, err := strconv.Atoi(chi.URLParam(req, `id`))
+	if err != nil {
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+	if userID == adminID {
+		http.Error(res, `own role can not be changed`, http.StatusConflict)
+		return
+	}
+
+	contentBody, err := io.ReadAll(req.Body)
+	defer req.Body.Close()
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `inconsistent body`, http.StatusBadRequest)
+		return
+	}
+	var change RoleChange
+	err = json.Unmarshal(contentBody, &change)
+	if err != nil || !validRole(change.Role) {
+		http.Error(res, ErrUnknownRole.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tag, err := s.DB.Pool.Exec(
+		req.Context(),
+		`update public.users set role = $1 where id = $2`,
+		change.Role, userID,
+	)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(res, `user not found`, http.StatusNotFound)
+		return
+	}
+
+	// токены несут старую роль, поэтому сессии пользователя закрываются
+	err = s.Sessions.RevokeAll(req.Context(), userID, 0)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+
+	s.Logger.Info(`role ` + change.Role + ` set for user: ` + strconv.Itoa(userID))
+	res.WriteHeader(http.StatusOK)
+}
+
+type APIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type APIKeyResponse struct {
+	apikey.Key
+	Secret string `json:"key"`
+}
+
+// AdminCreateAPIKey
+// Выпуск ключа партнёру. Ключ возвращается один раз, в базе хранится хэш.
+func (s *Server) AdminCreateAPIKey(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	adminID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+
+	contentBody, err := io.ReadAll(req.Body)
+	defer req.Body.Close()
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `inconsistent body`, http.StatusBadRequest)
+		return
+	}
+	var keyReq APIKeyRequest
+	err = json.Unmarshal(contentBody, &keyReq)
+	if err != nil || keyReq.Name == `` {
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+	if keyReq.ExpiresAt != nil && !keyReq.ExpiresAt.After(time.Now()) {
+		http.Error(res, `expires_at must be in the future`, http.StatusBadRequest)
+		return
+	}
+	if err = apikey.ValidateScopes(keyReq.Scopes); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key, secret, err := s.APIKeys.Create(req.Context(), keyReq.Name, keyReq.Scopes, keyReq.ExpiresAt, adminID)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	marshaled, err := json.Marshal(APIKeyResponse{Key: key, Secret: secret})
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	s.Logger.Info(`api key created: ` + key.Prefix)
+	res.Header().Add(`Content-Type`, `application/json`)
+	res.WriteHeader(http.StatusCreated)
+	_, err = res.Write(marshaled)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+}
+
+// AdminListAPIKeys
+// Список ключей без секретов, с временем последнего использования.
+func (s *Server) AdminListAPIKeys(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	keys, err := s.APIKeys.List(req.Context())
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	marshaled, err := json.Marshal(keys)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Add(`Content-Type`, `application/json`)
+	res.WriteHeader(http.StatusOK)
+	_, err = res.Write(marshaled)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+}
+
+// AdminRevokeAPIKey
+// Отзыв ключа, следующий запрос с ним получит 401.
+func (s *Server) AdminRevokeAPIKey(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(req, `id`))
+	if err != nil {
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+	err = s.APIKeys.Revoke(req.Context(), id)
+	if err != nil {
+		if errors.Is(err, apikey.ErrNotFound) {
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+		}
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	s.Logger.Info(`api key revoked: ` + strconv.Itoa(id))
+	res.WriteHeader(http.StatusOK)
+}
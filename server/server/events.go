@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"go-diploma/internal/utils/loginpolicy"
+	"go-diploma/server/audit"
+	"go-diploma/server/cookie"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var ErrQueryParam = errors.New(`invalid query parameter`)
+
+// recordEvent
+// Событие безопасности с адресом и клиентом из запроса.
+func (s *Server) recordEvent(req *http.Request, eventType string, userID int, login string, details map[string]string) {
+	s.Events.Record(req.Context(), newEvent(req, eventType, userID, login, details))
+}
+
+// newEvent событие с адресом и клиентом из запроса, для записи после ответа.
+func newEvent(req *http.Request, eventType string, userID int, login string, details map[string]string) audit.Event {
+	return audit.Event{
+		UserID:    userID,
+		Login:     login,
+		Type:      eventType,
+		IP:        clientIP(req),
+		UserAgent: req.UserAgent(),
+		Details:   details,
+	}
+}
+
+func withdrawDetails(w Withdrawal, reason string) map[string]string {
+	details := map[string]string{
+		`order`: w.Order,
+		`sum`:   w.Sum.String(),
+	}
+	if reason != `` {
+		details[`reason`] = reason
+	}
+	return details
+}
+
+// UserSecurityEvents
+// События безопасности своего аккаунта, от новых к старым
+func (s *Server) UserSecurityEvents(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+
+	filter, err := eventFilter(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.UserID = userID
+	filter.Login = ``
+
+	s.writeEvents(res, req, filter)
+}
+
+// AdminSecurityEvents
+// События по всем пользователям: фильтры user_id, login, type, since, until
+func (s *Server) AdminSecurityEvents(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	filter, err := eventFilter(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.writeEvents(res, req, filter)
+}
+
+func (s *Server) writeEvents(res http.ResponseWriter, req *http.Request, filter audit.Filter) {
+	events, err := s.Events.List(req.Context(), filter)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(res, http.StatusOK, events)
+}
+
+// eventFilter
+// Параметры выборки из query: before (ID события) и limit для страниц,
+// since и until в RFC 3339.
+func eventFilter(req *http.Request) (audit.Filter, error) {
+	query := req.URL.Query()
+	var f audit.Filter
+	var err error
+
+	if v := query.Get(`user_id`); v != `` {
+		if f.UserID, err = strconv.Atoi(v); err != nil {
+			return f, fmt.Errorf(`user_id: %w`, ErrQueryParam)
+		}
+	}
+	if v := query.Get(`before`); v != `` {
+		if f.BeforeID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return f, fmt.Errorf(`before: %w`, ErrQueryParam)
+		}
+	}
+	if v := query.Get(`limit`); v != `` {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 {
+			return f, fmt.Errorf(`limit: %w`, ErrQueryParam)
+		}
+	}
+	if v := query.Get(`since`); v != `` {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf(`since: %w`, ErrQueryParam)
+		}
+	}
+	if v := query.Get(`until`); v != `` {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf(`until: %w`, ErrQueryParam)
+		}
+	}
+	if v := query.Get(`login`); v != `` {
+		f.Login = loginpolicy.Normalize(v)
+	}
+	f.Type = query.Get(`type`)
+	return f, nil
+}
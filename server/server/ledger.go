@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"go-diploma/internal/utils/money"
+	"go-diploma/server/audit"
+	"go-diploma/server/cookie"
+	"go-diploma/server/ledger"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrCommentRequired = errors.New(`comment is required`)
+
+type Adjustment struct {
+	Amount  money.Amount `json:"amount"`
+	Comment string       `json:"comment"`
+}
+
+type Reversal struct {
+	Comment string `json:"comment"`
+}
+
+// BalanceHistory
+// Движение баллов пользователя по журналу, от новых записей к старым
+func (s *Server) BalanceHistory(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+
+	query := req.URL.Query()
+	var beforeID int64
+	var limit int
+	var err error
+	if v := query.Get(`before`); v != `` {
+		if beforeID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(res, `before: `+ErrQueryParam.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get(`limit`); v != `` {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(res, `limit: `+ErrQueryParam.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := s.Ledger.History(req.Context(), userID, beforeID, limit)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	s.writeJSON(res, http.StatusOK, entries)
+}
+
+// AdminAdjustBalance
+// Ручная корректировка баланса пользователя записью журнала
+func (s *Server) AdminAdjustBalance(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	adminID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+
+	userID, err := strconv.Atoi(chi.URLParam(req, `id`))
+	if err != nil {
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+
+	contentBody, err := io.ReadAll(req.Body)
+	defer req.Body.Close()
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `inconsistent body`, http.StatusBadRequest)
+		return
+	}
+	var adjustment Adjustment
+	err = json.Unmarshal(contentBody, &adjustment)
+	if err != nil {
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+	adjustment.Comment = strings.TrimSpace(adjustment.Comment)
+	if adjustment.Comment == `` {
+		http.Error(res, ErrCommentRequired.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err = s.DB.Pool.QueryRow(
+		req.Context(),
+		`select exists(select 1 from public.users where id = $1)`,
+		userID,
+	).Scan(&exists)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(res, `user not found`, http.StatusNotFound)
+		return
+	}
+
+	entryID, err := s.Ledger.Adjust(req.Context(), userID, adjustment.Amount, adjustment.Comment)
+	if err != nil {
+		if errors.Is(err, ledger.ErrZeroAmount) {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, ledger.ErrNegativeBalance) {
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+		}
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	s.Logger.Info(`balance adjusted for user: ` + strconv.Itoa(userID))
+	s.recordEvent(req, audit.EventBalanceAdjustment, userID, ``, map[string]string{
+		`entry_id`: strconv.FormatInt(entryID, 10),
+		`amount`:   adjustment.Amount.String(),
+		`admin_id`: strconv.Itoa(adminID),
+	})
+	s.writeJSON(res, http.StatusCreated, map[string]int64{`id`: entryID})
+}
+
+// AdminReverseEntry
+// Отмена записи журнала встречной записью
+func (s *Server) AdminReverseEntry(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	adminID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+
+	entryID, err := strconv.ParseInt(chi.URLParam(req, `id`), 10, 64)
+	if err != nil {
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+
+	contentBody, err := io.ReadAll(req.Body)
+	defer req.Body.Close()
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `inconsistent body`, http.StatusBadRequest)
+		return
+	}
+	var reversal Reversal
+	err = json.Unmarshal(contentBody, &reversal)
+	if err != nil {
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+	reversal.Comment = strings.TrimSpace(reversal.Comment)
+	if reversal.Comment == `` {
+		http.Error(res, ErrCommentRequired.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, err := s.Ledger.Reverse(req.Context(), entryID, reversal.Comment)
+	if err != nil {
+		switch {
+		case errors.Is(err, ledger.ErrNotFound):
+			http.Error(res, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ledger.ErrAlreadyReversed), errors.Is(err, ledger.ErrNotReversible),
+			errors.Is(err, ledger.ErrNegativeBalance):
+			http.Error(res, err.Error(), http.StatusConflict)
+		default:
+			s.Logger.Error(err.Error())
+			http.Error(res, `internal error`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.Logger.Info(`ledger entry reversed: ` + strconv.FormatInt(entryID, 10))
+	s.recordEvent(req, audit.EventLedgerReversal, entry.UserID, ``, map[string]string{
+		`entry_id`:    strconv.FormatInt(entry.ID, 10),
+		`reverses_id`: strconv.FormatInt(entryID, 10),
+		`admin_id`:    strconv.Itoa(adminID),
+	})
+	s.writeJSON(res, http.StatusCreated, entry)
+}
+
+// AdminReconcileLedger
+// Пользователи, у которых баланс расходится с журналом
+func (s *Server) AdminReconcileLedger(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	mismatches, err := s.Ledger.Reconcile(req.Context())
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	if len(mismatches) > 0 {
+		s.Logger.Warn(`ledger mismatches found: ` + strconv.Itoa(len(mismatches)))
+	}
+	s.writeJSON(res, http.StatusOK, mismatches)
+}
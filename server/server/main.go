@@ -4,22 +4,42 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/ShiraazMoollatjie/goluhn"
 	"github.com/go-chi/chi/v5"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"go-diploma/internal/accrual"
-	"go-diploma/internal/utils/hash/sha1hash"
+	"go-diploma/internal/utils/hash/passwordhash"
+	"go-diploma/internal/utils/loginpolicy"
+	"go-diploma/internal/utils/money"
+	"go-diploma/internal/utils/passwordpolicy"
+	"go-diploma/internal/utils/totp"
+	"go-diploma/server/apikey"
+	"go-diploma/server/audit"
 	"go-diploma/server/compress/gzipapp"
 	"go-diploma/server/config"
+	"go-diploma/server/control"
 	"go-diploma/server/cookie"
+	"go-diploma/server/idempotency"
+	"go-diploma/server/ledger"
+	"go-diploma/server/lockout"
+	"go-diploma/server/logger"
+	"go-diploma/server/mailer"
+	"go-diploma/server/passwordreset"
+	"go-diploma/server/session"
 	"go-diploma/server/storage/database"
+	"go-diploma/server/twofactor"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,8 +50,27 @@ type Server struct {
 	DB              database.Database
 	HTTP            http.Server
 	Accrual         accrual.Accrual
+	Passwords       passwordhash.Passwords
+	PasswordPolicy  passwordpolicy.Policy
+	LoginPolicy     loginpolicy.Policy
+	Tokens          *cookie.Tokens
+	Cookies         cookie.Attributes
+	Sessions        session.Store
+	Lockout         lockout.Guard
+	APIKeys         apikey.Store
+	TwoFactor       twofactor.Store
+	Events          audit.Recorder
+	Ledger          ledger.Ledger
+	Mailer          mailer.Mailer
+	PasswordResets  passwordreset.Store
+	Idempotency     idempotency.Store
+	Control         control.Server
+	StartedAt       time.Time
 	StopChan        chan struct{}
-	ShutdownProcess bool
+	ShutdownProcess atomic.Bool
+	stopping        atomic.Bool
+	// background задачи, начатые запросом и работающие после ответа (письма)
+	background sync.WaitGroup
 }
 
 func (s *Server) New(c config.Config, l *zap.Logger) error {
@@ -39,17 +78,90 @@ func (s *Server) New(c config.Config, l *zap.Logger) error {
 	s.Config = c
 	s.Routers = chi.NewRouter()
 	s.Logger = l
+	hasher := passwordhash.DefaultArgon2id()
+	hasher.Time = c.PasswordHash.Time
+	hasher.Memory = c.PasswordHash.Memory
+	hasher.Threads = c.PasswordHash.Threads
+	if err = hasher.Validate(); err != nil {
+		return err
+	}
+	s.Passwords = passwordhash.New(hasher)
+	s.PasswordPolicy, err = passwordpolicy.New(
+		c.PasswordPolicy.MinLength,
+		c.PasswordPolicy.MaxLength,
+		c.PasswordPolicy.Require,
+		c.PasswordPolicy.DenylistFile,
+	)
+	if err != nil {
+		return err
+	}
+	s.LoginPolicy, err = loginpolicy.New(c.LoginPolicy.MinLength, c.LoginPolicy.MaxLength, c.LoginPolicy.Pattern)
+	if err != nil {
+		return err
+	}
+	s.Tokens, err = cookie.NewTokens(c.JWT)
+	if err != nil {
+		return err
+	}
+	s.Cookies, err = cookie.NewAttributes(c.Cookie)
+	if err != nil {
+		return err
+	}
+	if s.Tokens.Ephemeral {
+		s.Logger.Warn(`JWT signing keys are not configured, tokens will not survive restart`)
+	}
 	err = s.DB.Init(context.Background(), c.DatabaseConnection)
 	if err != nil {
 		return err
 	}
+	s.Sessions.Init(s.DB.Pool, c.JWT.RefreshTTL)
+	s.Tokens.Sessions = &s.Sessions
+	s.Lockout.Init(s.DB.Pool, lockout.Policy{
+		LoginAttempts: c.Lockout.LoginAttempts,
+		IPAttempts:    c.Lockout.IPAttempts,
+		BaseDelay:     c.Lockout.BaseDelay,
+		MaxDelay:      c.Lockout.MaxDelay,
+		ResetAfter:    c.Lockout.ResetAfter,
+	})
+	s.APIKeys.Init(s.DB.Pool)
+	s.Events.Init(s.DB.Pool, l)
+	s.Ledger.Init(s.DB.Pool)
+	s.PasswordResets.Init(s.DB.Pool, c.PasswordReset.TTL)
+	s.Idempotency.Init(s.DB.Pool, c.Idempotency.TTL, c.Idempotency.Lease)
+	s.Mailer, err = mailer.New(c.Mail, l)
+	if err != nil {
+		return err
+	}
+	totpKey, err := twofactor.ParseKey(c.TOTP.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	err = s.TwoFactor.Init(s.DB.Pool, totp.New(c.TOTP.Skew), c.TOTP.Issuer, totpKey)
+	if err != nil {
+		return err
+	}
+	if totpKey == nil {
+		s.Logger.Warn(`TOTP encryption key is not configured, two-factor authentication is unavailable`)
+	} else {
+		sealed, err := s.TwoFactor.SealPlaintext(context.Background())
+		if err != nil {
+			return err
+		}
+		if sealed > 0 {
+			s.Logger.Info(`encrypted stored TOTP secrets`, zap.Int(`count`, sealed))
+		}
+	}
 	s.HTTP = http.Server{Addr: s.Config.MartAddress, Handler: s.Routers}
+	err = s.Control.Init(c.Control.Address, c.Control.Token, logger.Level, s, l)
+	if err != nil {
+		return err
+	}
 	accrualPath := filepath.Join(s.Config.LocalConfig.App.RootPath, s.Config.LocalConfig.App.AccrualPath)
 	err = s.Accrual.Init(s.Config.AccrualAddress, s.Config.DatabaseConnection, accrualPath)
 	if err != nil {
 		return err
 	}
-	s.ShutdownProcess = false
+	s.ShutdownProcess.Store(false)
 	return nil
 }
 
@@ -59,20 +171,66 @@ func (s *Server) Start() error {
 		return err
 	}
 
+	// Idempotency-Key только для денежных операций и загрузки заказов: ответы
+	// хранятся открытым текстом, ручки, которые возвращают секреты, сюда не добавлять
+	idempotent := idempotency.Middleware(&s.Idempotency, MaxBatchBytes, s.Logger)
+
 	s.Routers.With(gzipapp.GzipHandler)
 	s.Routers.Route(`/`, func(r chi.Router) {
 		s.Routers.Group(func(r chi.Router) {
-			r.Post(`/app/shutdown`, s.Shutdown)
 			r.Post(`/api/user/register`, s.UserRegister)
 			r.Post(`/api/user/login`, s.UserLogin)
+			r.Post(`/api/user/login/totp`, s.UserLoginTOTP)
+			r.Post(`/api/user/password/reset-request`, s.PasswordResetRequest)
+			r.Post(`/api/user/password/reset`, s.PasswordReset)
+			r.Post(`/api/user/token/refresh`, s.RefreshToken)
+			r.Get(`/.well-known/jwks.json`, s.JWKS)
 		})
+		// доступны и по ключу партнёра (X-API-Key) с нужным правом
 		s.Routers.Group(func(r chi.Router) {
-			r.Use(cookie.AuthChecker)
-			r.Post(`/api/user/orders`, s.SaveOrder)
-			r.Get(`/api/user/orders`, s.GetOrders)
-			r.Get(`/api/user/balance`, s.GetBalance)
-			r.Post(`/api/user/balance/withdraw`, s.Withdraw)
-			r.Get(`/api/user/withdrawals`, s.Withdrawals)
+			r.Use(apikey.AuthChecker(&s.APIKeys, s.Tokens.AuthChecker))
+			r.Use(cookie.CSRFChecker)
+			r.With(apikey.RequireScope(apikey.ScopeOrdersWrite), idempotent).Post(`/api/user/orders`, s.SaveOrder)
+			r.With(apikey.RequireScope(apikey.ScopeOrdersWrite), idempotent).Post(`/api/user/orders/batch`, s.SaveOrdersBatch)
+			r.With(apikey.RequireScope(apikey.ScopeOrdersRead)).Get(`/api/user/orders`, s.GetOrders)
+			r.With(apikey.RequireScope(apikey.ScopeOrdersRead)).Get(`/api/user/orders/{number}`, s.GetOrder)
+			r.With(apikey.RequireScope(apikey.ScopeBalanceRead)).Get(`/api/user/balance`, s.GetBalance)
+			r.With(apikey.RequireScope(apikey.ScopeBalanceRead)).Get(`/api/user/balance/history`, s.BalanceHistory)
+			r.With(apikey.RequireScope(apikey.ScopeWithdrawalsRead)).Get(`/api/user/withdrawals`, s.Withdrawals)
+		})
+		s.Routers.Group(func(r chi.Router) {
+			r.Use(s.Tokens.AuthChecker)
+			r.Use(cookie.CSRFChecker)
+			r.With(idempotent).Post(`/api/user/balance/withdraw`, s.Withdraw)
+			r.Post(`/api/user/logout`, s.Logout)
+			r.Post(`/api/user/logout/all`, s.LogoutAll)
+			r.Get(`/api/user/sessions`, s.ListSessions)
+			r.Delete(`/api/user/sessions/{id}`, s.RevokeSession)
+			r.Get(`/api/user/security-events`, s.UserSecurityEvents)
+			r.Post(`/api/user/password`, s.ChangePassword)
+			r.Put(`/api/user/email`, s.ChangeEmail)
+			r.Post(`/api/user/2fa/totp`, s.EnrollTOTP)
+			r.Post(`/api/user/2fa/totp/confirm`, s.ConfirmTOTP)
+			r.Delete(`/api/user/2fa/totp`, s.DisableTOTP)
+		})
+		s.Routers.Group(func(r chi.Router) {
+			r.Use(s.Tokens.AuthChecker)
+			r.Use(cookie.CSRFChecker)
+			r.Use(cookie.RequireRole(cookie.RoleOperator, cookie.RoleAdmin))
+			r.Post(`/api/admin/users/{login}/unlock`, s.AdminUnlockLogin)
+		})
+		s.Routers.Group(func(r chi.Router) {
+			r.Use(s.Tokens.AuthChecker)
+			r.Use(cookie.CSRFChecker)
+			r.Use(cookie.RequireRole(cookie.RoleAdmin))
+			r.Put(`/api/admin/users/{id}/role`, s.AdminSetRole)
+			r.Post(`/api/admin/api-keys`, s.AdminCreateAPIKey)
+			r.Get(`/api/admin/api-keys`, s.AdminListAPIKeys)
+			r.Delete(`/api/admin/api-keys/{id}`, s.AdminRevokeAPIKey)
+			r.Get(`/api/admin/security-events`, s.AdminSecurityEvents)
+			r.Post(`/api/admin/users/{id}/adjustments`, s.AdminAdjustBalance)
+			r.Post(`/api/admin/ledger/{id}/reversal`, s.AdminReverseEntry)
+			r.Get(`/api/admin/ledger/reconcile`, s.AdminReconcileLedger)
 		})
 	})
 
@@ -86,6 +244,18 @@ func (s *Server) Start() error {
 			return err
 		}
 	}
+	err = s.Control.Listen()
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := s.Control.Serve(); err != nil {
+			s.Logger.Error(err.Error())
+		}
+	}()
+	s.Logger.Info(`control interface listens on ` + s.Config.Control.Address)
+
+	s.StartedAt = time.Now()
 	go s.StartUpdateBackground()
 	err = s.HTTP.ListenAndServe()
 	if err != nil {
@@ -103,6 +273,11 @@ func (s *Server) Stop() error {
 	if err != nil {
 		s.Logger.Error(err.Error())
 	}
+	s.waitBackground()
+	err = s.Control.Stop(shutdownCtx)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
 	s.StopUpdateBackground()
 	err = s.Accrual.Stop()
 	if err != nil {
@@ -112,22 +287,69 @@ func (s *Server) Stop() error {
 	return nil
 }
 
-func (s *Server) Shutdown(res http.ResponseWriter, req *http.Request) {
-	s.ShutdownProcess = true
-	res.WriteHeader(http.StatusOK)
+// waitBackground
+// Новых запросов уже нет: ждём отправку начатых писем, но не дольше mailTimeout.
+func (s *Server) waitBackground() {
+	done := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(mailTimeout):
+		s.Logger.Warn(`background tasks did not finish before shutdown`)
+	}
+}
+
+// Shutdown
+// Остановка по команде управляющего интерфейса.
+func (s *Server) Shutdown() {
+	s.ShutdownProcess.Store(true)
+	s.stopping.Store(true)
 	_ = s.Stop()
 }
 
+// SetDraining
+// В режиме drain API отвечает 503, уже начатые запросы дорабатывают.
+func (s *Server) SetDraining(draining bool) {
+	s.ShutdownProcess.Store(draining)
+}
+
+func (s *Server) Status() control.Status {
+	st := control.Status{
+		State:     `running`,
+		Mode:      s.Config.Mode,
+		StartedAt: s.StartedAt,
+		Uptime:    time.Since(s.StartedAt).Round(time.Second).String(),
+		Database:  `ok`,
+	}
+	if s.ShutdownProcess.Load() {
+		st.State = `draining`
+	}
+	if s.stopping.Load() {
+		st.State = `stopping`
+		return st
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.DB.Pool.Ping(ctx); err != nil {
+		st.Database = err.Error()
+	}
+	return st
+}
+
 type User struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
 	pwdHash  string
 }
 
 // UserRegister
 // Регистрация пользователя
 func (s *Server) UserRegister(res http.ResponseWriter, req *http.Request) {
-	if s.ShutdownProcess {
+	if s.ShutdownProcess.Load() {
 		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
 		return
 	}
@@ -147,73 +369,104 @@ func (s *Server) UserRegister(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, `inconsistent request`, http.StatusBadRequest)
 		return
 	}
-	user.pwdHash, err = sha1hash.Hash(user.Password)
+	user.Login = loginpolicy.Normalize(user.Login)
+	violations := s.LoginPolicy.Validate(`login`, user.Login)
+	violations = append(violations, s.PasswordPolicy.Validate(`password`, user.Password, user.Login)...)
+	if user.Email != `` {
+		if user.Email, err = normalizeEmail(user.Email); err != nil {
+			violations = append(violations, emailViolation())
+		}
+	}
+	if len(violations) > 0 {
+		s.Logger.Warn(`login or password does not match policy`)
+		s.writeViolations(res, violations)
+		return
+	}
+
+	user.pwdHash, err = s.Passwords.Hash(user.Password)
 	if err != nil {
 		s.Logger.Error(err.Error())
 		http.Error(res, `inconsistent request`, http.StatusBadRequest)
 		return
 	}
 
-	s.Logger.Debug(user.pwdHash)
-
-	var userID int
-	row := s.DB.Pool.QueryRow(
-		req.Context(),
-		`insert into public.users (login, password_hash) values ($1, $2) returning id`,
-		user.Login, user.pwdHash,
-	)
-	err = row.Scan(&userID)
+	userID, err := s.createUser(req.Context(), user.Login, user.Email, user.pwdHash, cookie.RoleUser)
 	if err != nil {
-		var insertErr *pgconn.PgError
-		if errors.As(err, &insertErr) {
-			if insertErr.Code == `23505` {
-				s.Logger.Warn(err.Error())
-				http.Error(res, `duplicate user`, http.StatusConflict)
-				return
-			}
+		if errors.Is(err, ErrDuplicateEmail) {
+			s.Logger.Warn(err.Error())
+			http.Error(res, ErrDuplicateEmail.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, ErrDuplicateUser) {
+			s.Logger.Warn(err.Error())
+			http.Error(res, `duplicate user`, http.StatusConflict)
+			return
 		}
 		s.Logger.Error(err.Error())
 		http.Error(res, `internal error`, http.StatusInternalServerError)
 		return
 	}
 
-	_, err = s.DB.Pool.Exec(
-		req.Context(),
-		`insert into public.accruals (user_id) values ($1)`,
-		userID,
-	)
+	s.Logger.Info(`user saved`)
+	s.recordEvent(req, audit.EventRegister, userID, user.Login, nil)
 
+	tokens, err := s.startSession(res, req, userID)
 	if err != nil {
 		s.Logger.Error(err.Error())
 		http.Error(res, `internal error`, http.StatusInternalServerError)
 		return
 	}
 
-	s.Logger.Info(`user saved`)
+	s.Logger.Info(`user successfully created`)
+	s.respondTokens(res, req, tokens)
+}
 
-	jwtString, err := cookie.BuildJWTString(userID)
+var (
+	ErrDuplicateUser  = errors.New(`duplicate user`)
+	ErrDuplicateEmail = errors.New(`email is already used`)
+)
+
+// createUser
+// Создаёт пользователя вместе с его счётом баллов.
+// Email необязателен, без него восстановить пароль по почте нельзя.
+func (s *Server) createUser(ctx context.Context, login string, email string, pwdHash string, role string) (int, error) {
+	tx, err := s.DB.Pool.Begin(ctx)
 	if err != nil {
-		s.Logger.Error(err.Error())
-		http.Error(res, `internal error`, http.StatusInternalServerError)
-		return
+		return 0, err
 	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
 
-	regCookie := &http.Cookie{
-		Name:    `token`,
-		Value:   jwtString,
-		Expires: time.Now().Add(cookie.TokenExp),
-		Path:    `/`,
+	var userID int
+	err = tx.QueryRow(
+		ctx,
+		`insert into public.users (login, email, password_hash, role) values ($1, nullif($2, ''), $3, $4) returning id`,
+		login, email, pwdHash, role,
+	).Scan(&userID)
+	if err != nil {
+		var insertErr *pgconn.PgError
+		if errors.As(err, &insertErr) && insertErr.Code == `23505` {
+			if insertErr.ConstraintName == `unique_email` {
+				return 0, fmt.Errorf(err.Error()+`: %w`, ErrDuplicateEmail)
+			}
+			return 0, fmt.Errorf(err.Error()+`: %w`, ErrDuplicateUser)
+		}
+		return 0, err
 	}
-	http.SetCookie(res, regCookie)
 
-	s.Logger.Info(`user successfully created`)
-	res.WriteHeader(http.StatusOK)
+	_, err = tx.Exec(ctx, `insert into public.accruals (user_id) values ($1)`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit(ctx)
 }
 
 // UserLogin
 // Аутентификация пользователя
 func (s *Server) UserLogin(res http.ResponseWriter, req *http.Request) {
-	if s.ShutdownProcess {
+	if s.ShutdownProcess.Load() {
 		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
 		return
 	}
@@ -233,14 +486,14 @@ func (s *Server) UserLogin(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, `inconsistent request`, http.StatusBadRequest)
 		return
 	}
-	user.pwdHash, err = sha1hash.Hash(user.Password)
-	if err != nil {
-		s.Logger.Error(err.Error())
+	if user.Password == `` {
+		s.Logger.Error(passwordhash.ErrEmptyPassword.Error())
 		http.Error(res, `inconsistent request`, http.StatusBadRequest)
 		return
 	}
-	s.Logger.Debug(user.pwdHash)
+	user.Login = loginpolicy.Normalize(user.Login)
 
+	// пользователь нужен до проверки блокировки: отказ попадает в его журнал безопасности
 	row := s.DB.Pool.QueryRow(
 		req.Context(),
 		`select id, password_hash from public.users where login = $1`,
@@ -249,47 +502,132 @@ func (s *Server) UserLogin(res http.ResponseWriter, req *http.Request) {
 	var pwdHash string
 	var userID int
 	err = row.Scan(&userID, &pwdHash)
+	found := err == nil
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	attemptKeys := []string{lockout.LoginKey(user.Login), lockout.IPKey(clientIP(req))}
+	wait, err := s.Lockout.Attempt(req.Context(), attemptKeys...)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			s.Logger.Warn(`Decline user authority`)
-			http.Error(res, `unauthorized`, http.StatusUnauthorized)
-			return
-		}
 		s.Logger.Error(err.Error())
 		http.Error(res, `internal error`, http.StatusInternalServerError)
 		return
+	}
+	if wait > 0 {
+		s.recordEvent(req, audit.EventLoginFailure, userID, user.Login, map[string]string{`reason`: `locked`})
+		s.tooManyAttempts(res, wait)
+		return
+	}
 
+	if !found {
+		// тратим на ответ столько же времени, как для существующего логина
+		s.Passwords.VerifyDummy(user.Password)
+		s.declineLogin(res, req, 0, user.Login)
+		return
 	}
 
-	if user.pwdHash != pwdHash {
-		s.Logger.Warn(`Decline user authority`)
-		http.Error(res, `unauthorized`, http.StatusUnauthorized)
+	ok, rehash, err := s.Passwords.Verify(user.Password, pwdHash)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+	if !ok {
+		s.declineLogin(res, req, userID, user.Login)
 		return
 	}
+	if rehash {
+		s.rehashPassword(req.Context(), userID, user.Password, pwdHash)
+	}
 
-	jwtString, err := cookie.BuildJWTString(userID)
+	mfa, err := s.TwoFactor.Enabled(req.Context(), userID)
 	if err != nil {
 		s.Logger.Error(err.Error())
 		http.Error(res, `internal error`, http.StatusInternalServerError)
 		return
 	}
+	if mfa {
+		// счётчик не сбрасываем до верного кода, иначе знание пароля
+		// позволило бы перебирать коды без ограничений
+		err = s.Lockout.Refund(req.Context(), attemptKeys...)
+		if err != nil {
+			s.Logger.Error(err.Error())
+		}
+		s.requireSecondFactor(res, userID)
+		return
+	}
+
+	// счётчик по IP не сбрасываем: иначе подбор можно чередовать со входом в свой аккаунт
+	err = s.Lockout.Reset(req.Context(), attemptKeys[0])
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+	err = s.Lockout.Refund(req.Context(), attemptKeys[1:]...)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
 
-	regCookie := &http.Cookie{
-		Name:    `token`,
-		Value:   jwtString,
-		Expires: time.Now().Add(cookie.TokenExp),
-		Path:    `/`,
+	tokens, err := s.startSession(res, req, userID)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
 	}
-	http.SetCookie(res, regCookie)
 
 	s.Logger.Info(`user successfully authorized`)
-	res.WriteHeader(http.StatusOK)
+	s.recordEvent(req, audit.EventLoginSuccess, userID, user.Login, nil)
+	s.respondTokens(res, req, tokens)
+}
+
+// declineLogin
+// Отказ во входе, попытка уже учтена. Ответ одинаковый для неверного пароля
+// и несуществующего логина.
+func (s *Server) declineLogin(res http.ResponseWriter, req *http.Request, userID int, login string) {
+	s.recordEvent(req, audit.EventLoginFailure, userID, login, map[string]string{`reason`: `wrong_credentials`})
+	s.Logger.Warn(`Decline user authority`)
+	http.Error(res, `unauthorized`, http.StatusUnauthorized)
+}
+
+// tooManyAttempts
+// 429 с Retry-After, пока логин или адрес заблокированы.
+func (s *Server) tooManyAttempts(res http.ResponseWriter, wait time.Duration) {
+	s.Logger.Warn(`login is temporarily locked`)
+	res.Header().Set(`Retry-After`, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(res, `too many attempts`, http.StatusTooManyRequests)
+}
+
+// UnlockLogin
+// Снимает блокировку входа с логина (команда администратора).
+func (s *Server) UnlockLogin(ctx context.Context, login string) error {
+	return s.Lockout.Unlock(ctx, loginpolicy.Normalize(login))
+}
+
+// rehashPassword
+// Перезаписывает хэш пароля текущим алгоритмом после успешного входа.
+// Ошибка не мешает входу: хэш обновится при следующей попытке.
+func (s *Server) rehashPassword(ctx context.Context, userID int, password, oldHash string) {
+	newHash, err := s.Passwords.Hash(password)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		return
+	}
+	_, err = s.DB.Pool.Exec(
+		ctx,
+		`update public.users set password_hash = $1 where id = $2 and password_hash = $3`,
+		newHash, userID, oldHash,
+	)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		return
+	}
+	s.Logger.Info(`password hash upgraded for user: ` + strconv.Itoa(userID))
 }
 
 // SaveOrder
 // Загрузка номера заказа
 func (s *Server) SaveOrder(res http.ResponseWriter, req *http.Request) {
-	if s.ShutdownProcess {
+	if s.ShutdownProcess.Load() {
 		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
 		return
 	}
@@ -312,89 +650,50 @@ func (s *Server) SaveOrder(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// быстрая проверка, чтобы не ходить в accrual за уже загруженным номером.
+	// Окончательно решает insertOrder: номер могут загрузить одновременно
 	var savedOrderUserID int
 	err = s.DB.Pool.QueryRow(
 		req.Context(),
 		`select user_id from public.orders where number = $1`,
 		orderNum,
 	).Scan(&savedOrderUserID)
-
-	isSavedOrder := true
-
-	if savedOrderUserID == 0 {
-		isSavedOrder = false
-		s.Logger.Debug(`saving is allowed`)
-		s.Logger.Info(`saved order user id: ` + strconv.Itoa(savedOrderUserID))
-	}
-
 	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
 		s.Logger.Error(err.Error())
-		http.Error(res, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if userID == savedOrderUserID && isSavedOrder {
-		s.Logger.Warn(`order was uploaded by current user`)
-		res.WriteHeader(http.StatusOK)
-		return
-	}
-
-	if userID != savedOrderUserID && isSavedOrder {
-		s.Logger.Warn(`order was uploaded by another user`)
-		http.Error(res, `another user`, http.StatusConflict)
+		http.Error(res, `internal error`, http.StatusInternalServerError)
 		return
 	}
 
-	isEmptyAccrual := false
-	accrualData, err := s.Accrual.GetOrderInfo(orderNum)
-	if err != nil {
-		isEmptyAccrual = true
-		s.Logger.Warn(err.Error())
-	}
-
-	if isEmptyAccrual {
-		_, err = s.DB.Pool.Exec(
-			req.Context(),
-			`insert into public.orders (user_id, number) values ($1, $2)`,
-			userID,
-			orderNum,
-		)
-		if err != nil {
-			s.Logger.Error(err.Error())
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
+	created := false
+	if err == nil {
+		if savedOrderUserID != userID {
+			err = ErrOrderConflict
 		}
 	} else {
-		_, err = s.DB.Pool.Exec(
-			req.Context(),
-			`insert into public.orders (user_id, number, status, accrual) values ($1, $2, $3, $4)`,
-			userID,
-			orderNum,
-			accrualData.Status,
-			accrualData.Accrual,
-		)
-		if err != nil {
-			s.Logger.Error(err.Error())
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
+		var info *config.GetOrderData
+		accrualData, errAccrual := s.Accrual.GetOrderInfo(orderNum)
+		if errAccrual != nil {
+			s.Logger.Warn(errAccrual.Error())
+		} else {
+			info = &accrualData
 		}
+		created, err = s.insertOrder(req.Context(), userID, orderNum, info)
 	}
-	if !isEmptyAccrual {
-		_, err = s.DB.Pool.Exec(
-			req.Context(),
-			`update public.accruals
-				 set
-	                      current_balance = current_balance + $2
-				where
-				    user_id = $1`,
-			userID,
-			accrualData.Accrual,
-		)
-		if err != nil {
-			s.Logger.Error(err.Error())
-			http.Error(res, err.Error(), http.StatusInternalServerError)
+
+	if err != nil {
+		if errors.Is(err, ErrOrderConflict) {
+			s.Logger.Warn(`order was uploaded by another user`)
+			http.Error(res, ErrOrderConflict.Error(), http.StatusConflict)
 			return
 		}
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	if !created {
+		s.Logger.Warn(`order was uploaded by current user`)
+		res.WriteHeader(http.StatusOK)
+		return
 	}
 
 	s.Logger.Info(`successfully saved order: ` + orderNum)
@@ -404,44 +703,61 @@ func (s *Server) SaveOrder(res http.ResponseWriter, req *http.Request) {
 // GetOrders
 // Получение текущего баланса пользователя
 func (s *Server) GetOrders(res http.ResponseWriter, req *http.Request) {
-	if s.ShutdownProcess {
+	if s.ShutdownProcess.Load() {
 		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
 	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
 
-	rows, err := s.DB.Pool.Query(req.Context(),
-		`select 
-    			number, 
-    			status, 
-    			round(cast(accrual as numeric), 2) as accrual, 
-    			uploaded_at 
-			from public.orders 
-			where user_id = $1`,
-		userID)
+	filter, err := ordersFilter(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query, args := filter.query(userID)
+	rows, err := s.DB.Pool.Query(req.Context(), query, args...)
 	if err != nil {
-		if !errors.Is(err, pgx.ErrNoRows) {
-			s.Logger.Error(err.Error())
-			http.Error(res, "internal error", http.StatusInternalServerError)
-			return
-		}
 		s.Logger.Error(err.Error())
-		http.Error(res, "", http.StatusNoContent)
+		http.Error(res, "internal error", http.StatusInternalServerError)
 		return
 	}
+	defer rows.Close()
 
 	var savedOrders []config.GetOrderData
+	var last OrderCursor
+	hasNext := false
 	for rows.Next() {
+		if len(savedOrders) == filter.limit() {
+			hasNext = true
+			break
+		}
 		var savedOrder config.GetOrderData
-		err := rows.Scan(&savedOrder.OrderNum, &savedOrder.Status, &savedOrder.Accrual, &savedOrder.UploadedAt)
+		var uploadedAt time.Time
+		err := rows.Scan(&last.ID, &savedOrder.OrderNum, &savedOrder.Status, &savedOrder.Accrual, &uploadedAt)
 		if err != nil {
 			s.Logger.Error(err.Error())
 			http.Error(res, "internal error", http.StatusInternalServerError)
 			return
 		}
+		last.UploadedAt = uploadedAt
+		savedOrder.UploadedAt = uploadedAt
 		savedOrders = append(savedOrders, savedOrder)
 	}
+	if err = rows.Err(); err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if len(savedOrders) == 0 {
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if hasNext {
+		res.Header().Set(`Link`, nextPageLink(req, last))
+	}
 
 	marshaledOrders, err := json.Marshal(savedOrders)
 	if err != nil {
@@ -461,14 +777,15 @@ func (s *Server) GetOrders(res http.ResponseWriter, req *http.Request) {
 }
 
 type Balance struct {
-	Balance   float32 `json:"current"`
-	Withdrawn float32 `json:"withdrawn"`
+	Balance   money.Amount `json:"current"`
+	Withdrawn money.Amount `json:"withdrawn"`
 }
 
 // GetBalance
-// Получение текущего баланса пользователя
+// Получение текущего баланса пользователя. accruals - проекция журнала
+// ledger_entries, сверка - /api/admin/ledger/reconcile
 func (s *Server) GetBalance(res http.ResponseWriter, req *http.Request) {
-	if s.ShutdownProcess {
+	if s.ShutdownProcess.Load() {
 		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
 		return
 	}
@@ -478,9 +795,8 @@ func (s *Server) GetBalance(res http.ResponseWriter, req *http.Request) {
 	var bal Balance
 	err := s.DB.Pool.QueryRow(
 		req.Context(),
-		`select round(cast(current_balance as numeric), 2) as current_balance, 
-       				round(cast(total_withdrawn as numeric), 2) as total_withdrawn 
-			from public.accruals 
+		`select current_balance, total_withdrawn
+			from public.accruals
 			where user_id = $1`,
 		userID,
 	).Scan(&bal.Balance, &bal.Withdrawn)
@@ -514,7 +830,7 @@ func (s *Server) GetBalance(res http.ResponseWriter, req *http.Request) {
 // Withdraw
 // Запрос на списание средств
 func (s *Server) Withdraw(res http.ResponseWriter, req *http.Request) {
-	if s.ShutdownProcess {
+	if s.ShutdownProcess.Load() {
 		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
 		return
 	}
@@ -537,92 +853,48 @@ func (s *Server) Withdraw(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	s.Logger.Info(`try to withdraw sum: ` + strconv.Itoa(int(w.Sum)) + ` by order: ` + w.Order)
-
-	var acc float32
-	err = s.DB.Pool.QueryRow(req.Context(),
-		//`select round(cast(accrual as numeric), 2) as accrual from public.orders where number = $1`,
-		//w.Order,
-		`select round(cast(current_balance as numeric), 2) as accrual from accruals where user_id = $1`,
-		userID,
-	).Scan(&acc)
-	if err != nil {
-		s.Logger.Error(err.Error())
-		if errors.Is(err, pgx.ErrNoRows) {
-			http.Error(res, `no orders`, http.StatusUnprocessableEntity)
-			return
-		} else {
-			http.Error(res, ``, http.StatusInternalServerError)
-			return
-		}
-	}
+	s.Logger.Info(`try to withdraw sum: ` + w.Sum.String() + ` by order: ` + w.Order)
 
-	if w.Sum > acc {
-		s.Logger.Error(`insufficient funds`)
-		http.Error(res, `insufficient funds`, http.StatusPaymentRequired)
+	if w.Sum <= 0 {
+		http.Error(res, `sum must be positive`, http.StatusUnprocessableEntity)
 		return
 	}
 
-	tx, err := s.DB.Pool.Begin(req.Context())
-	if err != nil {
-		s.Logger.Error(err.Error())
-		http.Error(res, ``, http.StatusInternalServerError)
+	if w.Sum > s.Config.TOTP.WithdrawThreshold && !s.checkWithdrawCode(res, req, userID) {
+		s.recordEvent(req, audit.EventWithdrawFailure, userID, ``, withdrawDetails(w, `second_factor`))
 		return
 	}
 
-	eg := errgroup.Group{}
-
-	eg.Go(func() error {
-		//_, err = tx.Exec(req.Context(), `update public.orders set accrual = accrual-$1 where number = $2`,
-		//	w.Sum, w.Order)
-		//if err != nil {
-		//	return err
-		//}
-		_, err = tx.Exec(
-			req.Context(),
-			`insert into public.withdrawals (user_id, sum, order_number)
-					values ($1, $2, $3)`,
-			userID, w.Sum, w.Order)
-		if err != nil {
-			return err
-		}
-		_, err = tx.Exec(req.Context(),
-			`update public.accruals set current_balance = current_balance-$1,
-	                      total_withdrawn = total_withdrawn+$2
-	                  where user_id = $3`,
-			w.Sum, w.Sum, userID)
-		if err != nil {
-			return err
-		}
-		return nil
-	})
-
-	if err = eg.Wait(); err != nil {
-		s.Logger.Error(err.Error())
-		errRollback := tx.Rollback(req.Context())
-		if errRollback != nil {
-			s.Logger.Error(errRollback.Error())
+	err = s.withdraw(req.Context(), userID, w)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNoBalance):
+			s.Logger.Warn(err.Error())
+			http.Error(res, `no orders`, http.StatusUnprocessableEntity)
+		case errors.Is(err, ErrInsufficientFunds):
+			s.Logger.Warn(err.Error())
+			s.recordEvent(req, audit.EventWithdrawFailure, userID, ``, withdrawDetails(w, `insufficient_funds`))
+			http.Error(res, `insufficient funds`, http.StatusPaymentRequired)
+		default:
+			s.Logger.Error(err.Error())
+			http.Error(res, ``, http.StatusInternalServerError)
 		}
-		http.Error(res, ``, http.StatusInternalServerError)
 		return
 	}
-	if err = tx.Commit(req.Context()); err != nil {
-		http.Error(res, ``, http.StatusInternalServerError)
-		s.Logger.Error(err.Error())
-	}
 
+	s.recordEvent(req, audit.EventWithdraw, userID, ``, withdrawDetails(w, ``))
 	res.WriteHeader(http.StatusOK)
 }
 
 type Withdrawal struct {
-	Order string  `json:"order"`
-	Sum   float32 `json:"sum"`
+	Order string       `json:"order"`
+	Sum   money.Amount `json:"sum"`
 }
 
 // Withdrawals
 // Получение информации о выводе средств
 func (s *Server) Withdrawals(res http.ResponseWriter, req *http.Request) {
-	if s.ShutdownProcess {
+	if s.ShutdownProcess.Load() {
 		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
 		return
 	}
@@ -631,9 +903,8 @@ func (s *Server) Withdrawals(res http.ResponseWriter, req *http.Request) {
 
 	rows, err := s.DB.Pool.Query(
 		req.Context(),
-		`select round(cast(sum as numeric), 2) as sum, 
-       				order_number 
-			from public.withdrawals 
+		`select sum, order_number
+			from public.withdrawals
 			where user_id = $1`,
 		userID,
 	)
@@ -689,6 +960,7 @@ func (s *Server) StartUpdateBackground() {
 	s.StopChan = make(chan struct{})
 	defer close(s.StopChan)
 
+	var purgedAt time.Time
 	for {
 		var sleeper time.Duration
 		sleeper = 1
@@ -700,6 +972,22 @@ func (s *Server) StartUpdateBackground() {
 			time.Sleep(sleeper * time.Second)
 		}
 
+		if time.Since(purgedAt) >= idempotency.PurgeInterval {
+			purgedAt = time.Now()
+			purged, err := s.Idempotency.Purge(ctx)
+			if err != nil {
+				s.Logger.Warn(err.Error())
+			} else if purged > 0 {
+				s.Logger.Debug(`purged expired idempotency keys`, zap.Int64(`count`, purged))
+			}
+			purged, err = s.TwoFactor.PurgeChallenges(ctx)
+			if err != nil {
+				s.Logger.Warn(err.Error())
+			} else if purged > 0 {
+				s.Logger.Debug(`purged used login challenges`, zap.Int64(`count`, purged))
+			}
+		}
+
 		unhandledOrders, err := s.GetUnhandledOrders()
 		if err != nil {
 			s.Logger.Warn(err.Error())
@@ -725,19 +1013,11 @@ func (s *Server) StartUpdateBackground() {
 
 			eg := errgroup.Group{}
 			eg.Go(func() error {
-				_, err = tx.Exec(ctx, `update public.orders set status = $1, accrual = $2 where number = $3`,
-					info.Status, info.Accrual, orderNum)
-				if err != nil {
-					return err
-				}
-				_, err = tx.Exec(ctx,
-					`update public.accruals set current_balance = current_balance + $1
-                       		where user_id = (select user_id from public.orders where number = $2)`,
-					info.Accrual, orderNum)
+				orderID, err := updateOrderStatus(ctx, tx, orderNum, info.Status, info.Accrual)
 				if err != nil {
 					return err
 				}
-				return nil
+				return creditOrder(ctx, tx, orderID)
 			})
 
 			if err = eg.Wait(); err != nil {
@@ -786,3 +1066,13 @@ func (s *Server) GetUnhandledOrders() (UnhandledOrders, error) {
 
 	return unhandledOrders, nil
 }
+
+// clientIP
+// Адрес клиента без порта.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -1 +1,444 @@
 package server
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-diploma/internal/utils/money"
+	"go-diploma/server/audit"
+	"go-diploma/server/cookie"
+	"go-diploma/server/storage/database/databasetest"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer сервер с подключением к тестовой базе из TEST_DATABASE_URI.
+// Без базы тест пропускается.
+func testServer(t *testing.T) *Server {
+	s := &Server{Logger: zap.NewNop(), DB: *databasetest.New(t)}
+	s.Ledger.Init(s.DB.Pool)
+	return s
+}
+
+func TestWantsTokenBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		accept string
+		want   bool
+	}{
+		{name: `Test browser request`, target: `/api/user/login`, accept: `text/html,*/*;q=0.8`, want: false},
+		{name: `Test no accept`, target: `/api/user/login`, want: false},
+		{name: `Test accept json`, target: `/api/user/login`, accept: `application/json`, want: true},
+		{name: `Test accept json among others`, target: `/api/user/login`, accept: `text/plain, application/json;q=0.9`, want: true},
+		{name: `Test query flag`, target: `/api/user/login?token=json`, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.target, nil)
+			if tt.accept != `` {
+				req.Header.Set(`Accept`, tt.accept)
+			}
+			assert.Equal(t, tt.want, wantsTokenBody(req))
+		})
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   audit.Filter
+		err    error
+	}{
+		{name: `Test no params`, target: `/api/user/security-events`, want: audit.Filter{}},
+		{
+			name:   `Test page params`,
+			target: `/api/admin/security-events?user_id=3&before=120&limit=20&type=login_failure`,
+			want:   audit.Filter{UserID: 3, BeforeID: 120, Limit: 20, Type: audit.EventLoginFailure},
+		},
+		{
+			name:   `Test login is normalized`,
+			target: `/api/admin/security-events?login=%20Alice&since=2024-01-01T00:00:00Z`,
+			want:   audit.Filter{Login: `alice`, Since: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{name: `Test bad limit`, target: `/api/user/security-events?limit=0`, err: ErrQueryParam},
+		{name: `Test bad since`, target: `/api/user/security-events?since=yesterday`, err: ErrQueryParam},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			got, err := eventFilter(req)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+		want  string
+		err   error
+	}{
+		{name: `Test plain address`, email: `alice@example.com`, want: `alice@example.com`},
+		{name: `Test spaces`, email: ` alice@example.com `, want: `alice@example.com`},
+		{name: `Test display name`, email: `Alice <alice@example.com>`, err: ErrInvalidEmail},
+		{name: `Test not an address`, email: `alice`, err: ErrInvalidEmail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeEmail(tt.email)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestInsertOrder_Concurrent(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+
+	number := strconv.FormatInt(time.Now().UnixNano(), 10)
+	owners := []int{databasetest.UserID(), databasetest.UserID()}
+	t.Cleanup(func() {
+		_, _ = s.DB.Pool.Exec(ctx, `delete from public.orders where number = $1`, number)
+	})
+
+	const uploads = 32
+	type result struct {
+		userID  int
+		created bool
+		err     error
+	}
+	results := make(chan result, uploads)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(userID int) {
+			defer wg.Done()
+			<-start
+			created, err := s.insertOrder(ctx, userID, number, nil)
+			results <- result{userID: userID, created: created, err: err}
+		}(owners[i%len(owners)])
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+
+	winner := 0
+	var all []result
+	for r := range results {
+		all = append(all, r)
+		if r.created {
+			assert.Zero(t, winner, `order created twice`)
+			winner = r.userID
+		}
+	}
+	require.NotZero(t, winner, `order was not created`)
+	for _, r := range all {
+		if r.created {
+			continue
+		}
+		if r.userID == winner {
+			assert.NoError(t, r.err)
+		} else {
+			assert.ErrorIs(t, r.err, ErrOrderConflict)
+		}
+	}
+
+	var count int
+	require.NoError(t, s.DB.Pool.QueryRow(ctx, `select count(*) from public.orders where number = $1`, number).Scan(&count))
+	assert.Equal(t, 1, count)
+}
+
+func TestParseBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []string
+		err         error
+	}{
+		{name: `Test json strings`, contentType: `application/json`, body: `["12345678903", " 2377225624 "]`, want: []string{`12345678903`, `2377225624`}},
+		{name: `Test json numbers`, contentType: `application/json`, body: `[12345678903, "2377225624"]`, want: []string{`12345678903`, `2377225624`}},
+		{name: `Test json not a number`, contentType: `application/json`, body: `[true]`, want: []string{`true`}},
+		{name: `Test text lines`, contentType: `text/plain; charset=utf-8`, body: "12345678903\n2377225624\r\n\n", want: []string{`12345678903`, `2377225624`}},
+		{name: `Test empty json`, contentType: `application/json`, body: `[]`, err: ErrEmptyBatch},
+		{name: `Test empty text`, contentType: `text/plain`, body: "\n", err: ErrEmptyBatch},
+		{name: `Test too large`, contentType: `text/plain`, body: strings.Repeat("1\n", MaxBatchOrders+1), err: ErrBatchTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBatch(tt.contentType, []byte(tt.body))
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSaveOrdersBatch_BodyLimit(t *testing.T) {
+	s := &Server{Logger: zap.NewNop()}
+	req := httptest.NewRequest(http.MethodPost, `/api/user/orders/batch`, strings.NewReader(strings.Repeat(" ", MaxBatchBytes+1)))
+	req.Header.Set(`Content-Type`, `text/plain`)
+	req = req.WithContext(context.WithValue(req.Context(), cookie.UserNum(`UserID`), 1))
+	res := httptest.NewRecorder()
+	s.SaveOrdersBatch(res, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+}
+
+func TestInsertOrders(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+
+	base := time.Now().UnixNano()
+	mine := strconv.FormatInt(base, 10)
+	foreign := strconv.FormatInt(base+1, 10)
+	fresh := strconv.FormatInt(base+2, 10)
+	t.Cleanup(func() {
+		_, _ = s.DB.Pool.Exec(ctx, `delete from public.orders where number = any($1::text[])`, []string{mine, foreign, fresh})
+	})
+
+	userID, otherID := databasetest.UserID(), databasetest.UserID()
+	_, err := s.insertOrder(ctx, userID, mine, nil)
+	require.NoError(t, err)
+	_, err = s.insertOrder(ctx, otherID, foreign, nil)
+	require.NoError(t, err)
+
+	results, err := s.insertOrders(ctx, userID, []string{mine, foreign, fresh})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		mine:    BatchAlreadyYours,
+		foreign: BatchAnotherUser,
+		fresh:   BatchAccepted,
+	}, results)
+}
+
+func TestOrdersFilter(t *testing.T) {
+	cursor := OrderCursor{UploadedAt: time.Date(2024, 3, 1, 10, 0, 0, 123456000, time.UTC), ID: 42}
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		url   string
+		query string
+		args  []any
+		err   error
+	}{
+		{
+			name:  `Test defaults`,
+			url:   `/api/user/orders`,
+			query: `where user_id = $1 order by uploaded_at desc, id desc limit 101`,
+			args:  []any{7},
+		},
+		{
+			name:  `Test filters and ascending cursor`,
+			url:   `/api/user/orders?status=new,processed&since=2024-01-01T00:00:00Z&sort=asc&limit=10&cursor=` + cursor.String(),
+			query: `where user_id = $1 and status = any($2::text[]) and uploaded_at >= $3 and (uploaded_at, id) > ($4, $5) order by uploaded_at asc, id asc limit 11`,
+			args:  []any{7, []string{`NEW`, `PROCESSED`}, since, cursor.UploadedAt, 42},
+		},
+		{
+			name:  `Test descending cursor and limit cap`,
+			url:   `/api/user/orders?limit=100000&cursor=` + cursor.String(),
+			query: `where user_id = $1 and (uploaded_at, id) < ($2, $3) order by uploaded_at desc, id desc limit 501`,
+			args:  []any{7, cursor.UploadedAt, 42},
+		},
+		{name: `Test unknown status`, url: `/api/user/orders?status=DONE`, err: ErrQueryParam},
+		{name: `Test bad sort`, url: `/api/user/orders?sort=up`, err: ErrQueryParam},
+		{name: `Test bad cursor`, url: `/api/user/orders?cursor=!!`, err: ErrQueryParam},
+		{name: `Test bad since`, url: `/api/user/orders?since=yesterday`, err: ErrQueryParam},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ordersFilter(httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			query, args := f.query(7)
+			assert.Equal(t, tt.query, strings.Join(strings.Fields(query[strings.Index(query, `where`):]), ` `))
+			assert.Equal(t, tt.args, args)
+		})
+	}
+}
+
+func TestNextPageLink(t *testing.T) {
+	cursor := OrderCursor{UploadedAt: time.UnixMicro(1700000000123456).UTC(), ID: 5}
+	req := httptest.NewRequest(http.MethodGet, `http://mart.local/api/user/orders?status=NEW&cursor=old`, nil)
+
+	assert.Equal(t, `</api/user/orders?cursor=`+cursor.String()+`&status=NEW>; rel="next"`, nextPageLink(req, cursor))
+
+	parsed, err := parseOrderCursor(cursor.String())
+	require.NoError(t, err)
+	assert.Equal(t, cursor, *parsed)
+}
+
+func TestUpdateOrderStatus_History(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+
+	number := strconv.FormatInt(time.Now().UnixNano(), 10)
+	t.Cleanup(func() {
+		_, _ = s.DB.Pool.Exec(ctx, `delete from public.orders where number = $1`, number)
+	})
+	_, err := s.insertOrder(ctx, databasetest.UserID(), number, nil)
+	require.NoError(t, err)
+
+	// опрос ставит заказу PROCESSING, но в историю пишет только ответ accrual
+	unhandled, err := s.GetUnhandledOrders()
+	require.NoError(t, err)
+	assert.Contains(t, unhandled, number)
+
+	for _, step := range []struct {
+		status  string
+		accrual money.Amount
+	}{
+		{status: `PROCESSING`},
+		{status: `PROCESSING`},
+		{status: `PROCESSED`, accrual: 50050},
+		{status: `PROCESSED`, accrual: 50050},
+	} {
+		tx, err := s.DB.Pool.Begin(ctx)
+		require.NoError(t, err)
+		_, err = updateOrderStatus(ctx, tx, number, step.status, step.accrual)
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit(ctx))
+	}
+
+	rows, err := s.DB.Pool.Query(
+		ctx,
+		`select status from public.order_events
+			where order_id = (select id from public.orders where number = $1)
+			order by created_at, id`,
+		number,
+	)
+	require.NoError(t, err)
+	defer rows.Close()
+	var statuses []string
+	for rows.Next() {
+		var status string
+		require.NoError(t, rows.Scan(&status))
+		statuses = append(statuses, status)
+	}
+	assert.Equal(t, []string{`NEW`, `PROCESSING`, `PROCESSED`}, statuses)
+}
+
+func TestCreditOrder_Once(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+
+	// начисления остаются в журнале, поэтому у каждого запуска свой пользователь и заказ
+	userID := databasetest.UserID()
+	number := strconv.FormatInt(time.Now().UnixNano(), 10)
+	_, err := s.insertOrder(ctx, userID, number, nil)
+	require.NoError(t, err)
+
+	// ответы accrual по мере обработки и повторный опрос уже обработанного заказа
+	update := func(status string) error {
+		tx, err := s.DB.Pool.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		orderID, err := updateOrderStatus(ctx, tx, number, status, 29999)
+		if err != nil {
+			return err
+		}
+		if err = creditOrder(ctx, tx, orderID); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+	statuses := []string{`PROCESSING`, `PROCESSED`, `PROCESSED`, `PROCESSED`}
+	errs := make(chan error, len(statuses))
+	var wg sync.WaitGroup
+	for _, status := range statuses {
+		wg.Add(1)
+		go func(status string) {
+			defer wg.Done()
+			errs <- update(status)
+		}(status)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	var balance money.Amount
+	err = s.DB.Pool.QueryRow(ctx, `select current_balance from public.accruals where user_id = $1`, userID).Scan(&balance)
+	require.NoError(t, err)
+	assert.Equal(t, money.Amount(29999), balance)
+}
+
+func TestWithdraw_Concurrent(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+
+	userID := databasetest.UserID()
+	_, err := s.Ledger.Adjust(ctx, userID, 100000, `stress test balance`)
+	require.NoError(t, err)
+
+	// 50 списаний по 30 с баланса 1000: пройти могут ровно 33
+	const withdrawals = 50
+	errs := make(chan error, withdrawals)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < withdrawals; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs <- s.withdraw(ctx, userID, Withdrawal{Order: strconv.Itoa(userID) + strconv.Itoa(i), Sum: 3000})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	succeeded, declined := 0, 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		require.ErrorIs(t, err, ErrInsufficientFunds)
+		declined++
+	}
+	assert.Equal(t, 33, succeeded)
+	assert.Equal(t, 17, declined)
+
+	var balance, withdrawn money.Amount
+	err = s.DB.Pool.QueryRow(
+		ctx,
+		`select current_balance, total_withdrawn from public.accruals where user_id = $1`,
+		userID,
+	).Scan(&balance, &withdrawn)
+	require.NoError(t, err)
+	assert.Equal(t, money.Amount(1000), balance)
+	assert.Equal(t, money.Amount(99000), withdrawn)
+
+	mismatches, err := s.Ledger.Reconcile(ctx)
+	require.NoError(t, err)
+	for _, m := range mismatches {
+		assert.NotEqual(t, userID, m.UserID)
+	}
+}
@@ -0,0 +1,591 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ShiraazMoollatjie/goluhn"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"go-diploma/internal/utils/money"
+	"go-diploma/server/config"
+	"go-diploma/server/cookie"
+	"go-diploma/server/ledger"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrOrderConflict = errors.New(`order was uploaded by another user`)
+
+// insertOrder
+// Сохраняет заказ пользователя. Решение принимает один запрос: вставка с upsert
+// возвращает владельца номера и признак новой строки. Из одновременных загрузок
+// вставляется ровно одна, остальные ждут её фиксации и видят владельца.
+// Возвращает true для нового заказа, false - номер уже загружен этим пользователем,
+// ErrOrderConflict - другим. info - ответ accrual, если он уже известен.
+// По новому заказу в той же транзакции пишется история и начисление, если заказ уже обработан.
+func (s *Server) insertOrder(ctx context.Context, userID int, number string, info *config.GetOrderData) (bool, error) {
+	status := `NEW`
+	var accrual money.Amount
+	if info != nil {
+		status = info.Status
+		accrual = info.Accrual
+	}
+
+	tx, err := s.DB.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var orderID, ownerID int
+	var created bool
+	// пустой update нужен, чтобы returning вернул и уже существующую строку
+	err = tx.QueryRow(
+		ctx,
+		`insert into public.orders (user_id, number, status, accrual) values ($1, $2, $3, $4)
+			on conflict (number) do update set number = excluded.number
+			returning id, user_id, (xmax = 0)`,
+		userID, number, status, accrual,
+	).Scan(&orderID, &ownerID, &created)
+	if err != nil {
+		return false, err
+	}
+	if !created {
+		if ownerID != userID {
+			return false, ErrOrderConflict
+		}
+		return false, nil
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`insert into public.order_events (order_id, status, accrual) values ($1, $2, $3)`,
+		orderID, status, accrual,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	if err = creditOrder(ctx, tx, orderID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// Результаты загрузки номера в пакете.
+const (
+	BatchAccepted      = `accepted`
+	BatchAlreadyYours  = `already_uploaded`
+	BatchAnotherUser   = `uploaded_by_another_user`
+	BatchInvalidNumber = `invalid_number`
+)
+
+// MaxBatchOrders номеров в одном пакете.
+const MaxBatchOrders = 1000
+
+// MaxBatchBytes размер тела пакета: с запасом на кавычки, запятые и пробелы вокруг номеров.
+const MaxBatchBytes = MaxBatchOrders * 64
+
+var (
+	ErrEmptyBatch    = errors.New(`batch is empty`)
+	ErrBatchTooLarge = errors.New(`batch is too large`)
+)
+
+type BatchResult struct {
+	Number string `json:"number"`
+	Result string `json:"result"`
+}
+
+// parseBatch
+// Номера из JSON массива (строки или числа) или из text/plain - по одному
+// через пробелы или переводы строк.
+func parseBatch(contentType string, body []byte) ([]string, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var numbers []string
+	if mediaType == `text/plain` {
+		numbers = strings.Fields(string(body))
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var items []any
+		if err := decoder.Decode(&items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			switch v := item.(type) {
+			case string:
+				numbers = append(numbers, strings.TrimSpace(v))
+			case json.Number:
+				numbers = append(numbers, v.String())
+			default:
+				// не номер, но место в ответе у него есть
+				numbers = append(numbers, fmt.Sprint(v))
+			}
+		}
+	}
+	if len(numbers) == 0 {
+		return nil, ErrEmptyBatch
+	}
+	if len(numbers) > MaxBatchOrders {
+		return nil, fmt.Errorf(strconv.Itoa(MaxBatchOrders)+` numbers max: %w`, ErrBatchTooLarge)
+	}
+	return numbers, nil
+}
+
+// insertOrders
+// Сохраняет уже проверенные номера одной транзакцией и возвращает результат
+// по каждому номеру. Как и в insertOrder, решает уникальный индекс. Номера
+// вставляются по возрастанию: пакеты с общими номерами в разном порядке иначе
+// ждали бы друг друга на уникальном индексе.
+func (s *Server) insertOrders(ctx context.Context, userID int, numbers []string) (map[string]string, error) {
+	numbers = append([]string(nil), numbers...)
+	sort.Strings(numbers)
+	results := make(map[string]string, len(numbers))
+	tx, err := s.DB.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(
+		ctx,
+		`with inserted as (
+				insert into public.orders (user_id, number)
+				select $1, unnest($2::text[])
+				on conflict (number) do nothing
+				returning id, number, status
+			), events as (
+				insert into public.order_events (order_id, status)
+				select id, status from inserted
+			)
+			select number from inserted`,
+		userID, numbers,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var number string
+		if err = rows.Scan(&number); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		results[number] = BatchAccepted
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var existing []string
+	for _, number := range numbers {
+		if _, ok := results[number]; !ok {
+			existing = append(existing, number)
+		}
+	}
+	if len(existing) > 0 {
+		rows, err = tx.Query(
+			ctx,
+			`select number, user_id from public.orders where number = any($1::text[])`,
+			existing,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var number string
+			var ownerID int
+			if err = rows.Scan(&number, &ownerID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if ownerID == userID {
+				results[number] = BatchAlreadyYours
+			} else {
+				results[number] = BatchAnotherUser
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, number := range numbers {
+		if _, ok := results[number]; !ok {
+			return nil, fmt.Errorf(`order `+number+`: %w`, pgx.ErrNoRows)
+		}
+	}
+	return results, tx.Commit(ctx)
+}
+
+// SaveOrdersBatch
+// Загрузка нескольких номеров: сначала проверяются все номера, затем
+// корректные сохраняются одной транзакцией. Ответ - результат по каждому номеру
+// в порядке запроса.
+func (s *Server) SaveOrdersBatch(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+
+	contentBody, err := io.ReadAll(http.MaxBytesReader(res, req.Body, MaxBatchBytes))
+	defer req.Body.Close()
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(res, ErrBatchTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		s.Logger.Error(err.Error())
+		http.Error(res, `inconsistent body`, http.StatusBadRequest)
+		return
+	}
+	numbers, err := parseBatch(req.Header.Get(`Content-Type`), contentBody)
+	if err != nil {
+		http.Error(res, `inconsistent request: `+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var valid []string
+	seen := make(map[string]bool, len(numbers))
+	for _, number := range numbers {
+		if seen[number] || goluhn.Validate(number) != nil {
+			continue
+		}
+		seen[number] = true
+		valid = append(valid, number)
+	}
+
+	saved := map[string]string{}
+	if len(valid) > 0 {
+		saved, err = s.insertOrders(req.Context(), userID, valid)
+		if err != nil {
+			s.Logger.Error(err.Error())
+			http.Error(res, `internal error`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	results := make([]BatchResult, 0, len(numbers))
+	for _, number := range numbers {
+		result, ok := saved[number]
+		if !ok {
+			result = BatchInvalidNumber
+		}
+		results = append(results, BatchResult{Number: number, Result: result})
+	}
+
+	s.Logger.Info(`orders batch saved: ` + strconv.Itoa(len(valid)) + ` of ` + strconv.Itoa(len(numbers)))
+	s.writeJSON(res, http.StatusOK, results)
+}
+
+// Статусы заказа в системе расчёта баллов.
+var orderStatuses = map[string]bool{`NEW`: true, `PROCESSING`: true, `INVALID`: true, `PROCESSED`: true}
+
+const (
+	DefaultOrdersLimit = 100
+	MaxOrdersLimit     = 500
+)
+
+// OrdersFilter выборка заказов пользователя. По умолчанию от новых к старым.
+// Cursor - позиция последнего заказа предыдущей страницы.
+type OrdersFilter struct {
+	Statuses []string
+	Since    time.Time
+	Until    time.Time
+	Asc      bool
+	Cursor   *OrderCursor
+	Limit    int
+}
+
+// OrderCursor ключ сортировки заказа: время загрузки и ID для одинакового времени.
+type OrderCursor struct {
+	UploadedAt time.Time
+	ID         int
+}
+
+// String курсор для клиента - непрозрачная строка.
+func (c OrderCursor) String() string {
+	raw := strconv.FormatInt(c.UploadedAt.UnixMicro(), 10) + `.` + strconv.Itoa(c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseOrderCursor(cursor string) (*OrderCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	micro, id, found := strings.Cut(string(raw), `.`)
+	if !found {
+		return nil, ErrQueryParam
+	}
+	ts, err := strconv.ParseInt(micro, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	c := OrderCursor{UploadedAt: time.UnixMicro(ts).UTC()}
+	if c.ID, err = strconv.Atoi(id); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ordersFilter
+// Параметры из query: status (через запятую или несколько раз), since и until
+// в RFC 3339, sort=asc|desc, limit и cursor из ссылки на следующую страницу.
+func ordersFilter(req *http.Request) (OrdersFilter, error) {
+	query := req.URL.Query()
+	var f OrdersFilter
+	var err error
+
+	for _, value := range query[`status`] {
+		for _, status := range strings.Split(value, `,`) {
+			status = strings.ToUpper(strings.TrimSpace(status))
+			if !orderStatuses[status] {
+				return f, fmt.Errorf(`status: %w`, ErrQueryParam)
+			}
+			f.Statuses = append(f.Statuses, status)
+		}
+	}
+	if v := query.Get(`since`); v != `` {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf(`since: %w`, ErrQueryParam)
+		}
+	}
+	if v := query.Get(`until`); v != `` {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, fmt.Errorf(`until: %w`, ErrQueryParam)
+		}
+	}
+	switch query.Get(`sort`) {
+	case ``, `desc`:
+	case `asc`:
+		f.Asc = true
+	default:
+		return f, fmt.Errorf(`sort: %w`, ErrQueryParam)
+	}
+	if v := query.Get(`limit`); v != `` {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 {
+			return f, fmt.Errorf(`limit: %w`, ErrQueryParam)
+		}
+	}
+	if v := query.Get(`cursor`); v != `` {
+		if f.Cursor, err = parseOrderCursor(v); err != nil {
+			return f, fmt.Errorf(`cursor: %w`, ErrQueryParam)
+		}
+	}
+	return f, nil
+}
+
+func (f OrdersFilter) limit() int {
+	if f.Limit <= 0 {
+		return DefaultOrdersLimit
+	}
+	if f.Limit > MaxOrdersLimit {
+		return MaxOrdersLimit
+	}
+	return f.Limit
+}
+
+// query запрос страницы заказов. Выбирается на одну строку больше limit:
+// по ней видно, есть ли следующая страница.
+func (f OrdersFilter) query(userID int) (string, []any) {
+	args := []any{userID}
+	conditions := []string{`user_id = $1`}
+	add := func(condition string, arg ...any) {
+		for _, a := range arg {
+			args = append(args, a)
+			condition = strings.Replace(condition, `?`, `$`+strconv.Itoa(len(args)), 1)
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if len(f.Statuses) > 0 {
+		add(`status = any(?::text[])`, f.Statuses)
+	}
+	// uploaded_at без часового пояса хранится в UTC
+	if !f.Since.IsZero() {
+		add(`uploaded_at >= ?`, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		add(`uploaded_at < ?`, f.Until.UTC())
+	}
+	direction := `desc`
+	if f.Asc {
+		direction = `asc`
+	}
+	if f.Cursor != nil {
+		if f.Asc {
+			add(`(uploaded_at, id) > (?, ?)`, f.Cursor.UploadedAt, f.Cursor.ID)
+		} else {
+			add(`(uploaded_at, id) < (?, ?)`, f.Cursor.UploadedAt, f.Cursor.ID)
+		}
+	}
+
+	query := `select id, number, status, accrual, uploaded_at
+		from public.orders
+		where ` + strings.Join(conditions, ` and `) + `
+		order by uploaded_at ` + direction + `, id ` + direction + `
+		limit ` + strconv.Itoa(f.limit()+1)
+	return query, args
+}
+
+// nextPageLink ссылка для заголовка Link: тот же запрос с курсором следующей страницы.
+func nextPageLink(req *http.Request, cursor OrderCursor) string {
+	next := *req.URL
+	query := next.Query()
+	query.Set(`cursor`, cursor.String())
+	next.RawQuery = query.Encode()
+	next.Scheme = ``
+	next.Host = ``
+	return `<` + next.String() + `>; rel="next"`
+}
+
+// updateOrderStatus
+// Новое состояние заказа от accrual. В историю попадает только изменение
+// статуса или суммы: повторный опрос с тем же ответом её не засоряет.
+// Сравнивается с последней записью истории, а не со строкой заказа: статус
+// PROCESSING в строке ставит опрос, а в историю пишется только ответ accrual.
+func updateOrderStatus(ctx context.Context, tx pgx.Tx, number string, status string, accrual money.Amount) (int, error) {
+	var orderID int
+	err := tx.QueryRow(
+		ctx,
+		`select id from public.orders where number = $1 for update`,
+		number,
+	).Scan(&orderID)
+	if err != nil {
+		return 0, err
+	}
+
+	// отдельный запрос после блокировки видит историю, записанную параллельным опросом
+	_, err = tx.Exec(
+		ctx,
+		`with last as (
+				select status, accrual from public.order_events
+				where order_id = $3
+				order by created_at desc, id desc
+				limit 1
+			), updated as (
+				update public.orders set status = $1, accrual = $2
+				where id = $3
+			)
+			insert into public.order_events (order_id, status, accrual)
+			select $3, $1, $2
+			where not exists (
+				select 1 from last where last.status = $1 and last.accrual is not distinct from $2::numeric
+			)`,
+		status, accrual, orderID,
+	)
+	return orderID, err
+}
+
+// OrderEvent изменение состояния заказа.
+type OrderEvent struct {
+	Status    string       `json:"status"`
+	Accrual   money.Amount `json:"accrual,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type OrderDetail struct {
+	config.GetOrderData
+	History []OrderEvent `json:"history"`
+}
+
+// GetOrder
+// Заказ пользователя с историей статусов, от старых изменений к новым
+func (s *Server) GetOrder(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+	number := chi.URLParam(req, `number`)
+
+	var orderID int
+	var uploadedAt time.Time
+	var order OrderDetail
+	err := s.DB.Pool.QueryRow(
+		req.Context(),
+		`select id, number, status, accrual, uploaded_at
+			from public.orders
+			where number = $1 and user_id = $2`,
+		number, userID,
+	).Scan(&orderID, &order.OrderNum, &order.Status, &order.Accrual, &uploadedAt)
+	if err != nil {
+		// чужой заказ неотличим от несуществующего
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(res, `order not found`, http.StatusNotFound)
+			return
+		}
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	order.UploadedAt = uploadedAt
+
+	rows, err := s.DB.Pool.Query(
+		req.Context(),
+		`select status, accrual, created_at
+			from public.order_events
+			where order_id = $1
+			order by created_at, id`,
+		orderID,
+	)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	order.History = make([]OrderEvent, 0)
+	for rows.Next() {
+		var event OrderEvent
+		if err = rows.Scan(&event.Status, &event.Accrual, &event.CreatedAt); err != nil {
+			s.Logger.Error(err.Error())
+			http.Error(res, `internal error`, http.StatusInternalServerError)
+			return
+		}
+		order.History = append(order.History, event)
+	}
+	if err = rows.Err(); err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	s.writeJSON(res, http.StatusOK, order)
+}
+
+// creditOrder
+// Начисляет баллы за обработанный заказ. Начисление фиксируется строкой
+// order_credits с ключом по заказу: повторный опрос, ретрай или второй
+// обработчик ничего не добавят. Баланс меняет запись журнала.
+func creditOrder(ctx context.Context, tx pgx.Tx, orderID int) error {
+	_, err := tx.Exec(
+		ctx,
+		`with credit as (
+				insert into public.order_credits (order_id, user_id, amount)
+				select id, user_id, accrual from public.orders
+				where id = $1 and status = 'PROCESSED' and accrual > 0
+				on conflict (order_id) do nothing
+				returning order_id, user_id, amount
+			)
+			insert into public.ledger_entries (user_id, kind, amount, order_id)
+			select user_id, $2, amount, order_id from credit`,
+		orderID, ledger.KindAccrual,
+	)
+	return err
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"go-diploma/internal/utils/passwordpolicy"
+	"go-diploma/server/audit"
+	"go-diploma/server/cookie"
+	"go-diploma/server/lockout"
+	"io"
+	"net/http"
+)
+
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword
+// Смена пароля пользователем
+func (s *Server) ChangePassword(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+	sessionID := req.Context().Value(cookie.UserNum(`SessionID`)).(int)
+
+	contentBody, err := io.ReadAll(req.Body)
+	defer req.Body.Close()
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `inconsistent body`, http.StatusBadRequest)
+		return
+	}
+
+	var change PasswordChange
+	err = json.Unmarshal(contentBody, &change)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+	if change.CurrentPassword == `` {
+		s.writeViolations(res, []passwordpolicy.Violation{{
+			Field:   `current_password`,
+			Reason:  `required`,
+			Message: `is required`,
+		}})
+		return
+	}
+
+	var login, pwdHash string
+	err = s.DB.Pool.QueryRow(
+		req.Context(),
+		`select login, password_hash from public.users where id = $1`,
+		userID,
+	).Scan(&login, &pwdHash)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(res, `unauthorized`, http.StatusUnauthorized)
+			return
+		}
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	violations := s.PasswordPolicy.Validate(`new_password`, change.NewPassword, login)
+	if change.NewPassword == change.CurrentPassword {
+		violations = append(violations, passwordpolicy.Violation{
+			Field:   `new_password`,
+			Reason:  `same_as_current`,
+			Message: `must differ from current password`,
+		})
+	}
+	if len(violations) > 0 {
+		s.Logger.Warn(`password does not match policy`)
+		s.writeViolations(res, violations)
+		return
+	}
+
+	if !s.checkCurrentPassword(res, req, userID, login, pwdHash, change.CurrentPassword, audit.EventPasswordChangeFailure) {
+		return
+	}
+
+	newHash, err := s.Passwords.Hash(change.NewPassword)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	_, err = s.DB.Pool.Exec(
+		req.Context(),
+		`update public.users set password_hash = $1 where id = $2`,
+		newHash, userID,
+	)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	// остальные устройства должны войти заново с новым паролем
+	err = s.Sessions.RevokeAll(req.Context(), userID, sessionID)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+
+	s.Logger.Info(`password successfully changed`)
+	s.recordEvent(req, audit.EventPasswordChange, userID, login, nil)
+	res.WriteHeader(http.StatusOK)
+}
+
+// checkCurrentPassword
+// Подтверждение действия текущим паролем. Подбор пароля через такие ручки
+// ограничен так же, как вход, но своим счётчиком: блокировка здесь не мешает входу.
+// Возвращает false, если ответ уже отправлен.
+func (s *Server) checkCurrentPassword(
+	res http.ResponseWriter,
+	req *http.Request,
+	userID int,
+	login string,
+	pwdHash string,
+	password string,
+	failEvent string,
+) bool {
+	attemptKeys := []string{lockout.PasswordChangeKey(userID)}
+	wait, err := s.Lockout.Attempt(req.Context(), attemptKeys...)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return false
+	}
+	if wait > 0 {
+		s.tooManyAttempts(res, wait)
+		return false
+	}
+
+	ok, _, err := s.Passwords.Verify(password, pwdHash)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+	if !ok {
+		s.Logger.Warn(`wrong current password`)
+		s.recordEvent(req, failEvent, userID, login, map[string]string{`reason`: `wrong_current_password`})
+		http.Error(res, `wrong current password`, http.StatusForbidden)
+		return false
+	}
+	if err = s.Lockout.Reset(req.Context(), attemptKeys...); err != nil {
+		s.Logger.Error(err.Error())
+	}
+	return true
+}
+
+// writeViolations
+// 400 с перечнем нарушений по полям запроса.
+func (s *Server) writeViolations(res http.ResponseWriter, violations []passwordpolicy.Violation) {
+	marshaled, err := json.Marshal(struct {
+		Errors []passwordpolicy.Violation `json:"errors"`
+	}{Errors: violations})
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+
+	res.Header().Add(`Content-Type`, `application/json`)
+	res.WriteHeader(http.StatusBadRequest)
+	_, err = res.Write(marshaled)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+}
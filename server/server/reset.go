@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go-diploma/internal/utils/loginpolicy"
+	"go-diploma/internal/utils/passwordpolicy"
+	"go-diploma/server/audit"
+	"go-diploma/server/cookie"
+	"go-diploma/server/lockout"
+	"go-diploma/server/mailer"
+	"go-diploma/server/passwordreset"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+var ErrInvalidEmail = errors.New(`invalid email`)
+
+// mailTimeout сколько ждать почтовый сервер при отправке письма.
+const mailTimeout = 30 * time.Second
+
+type PasswordResetRequestBody struct {
+	Login string `json:"login"`
+	Email string `json:"email"`
+}
+
+type PasswordResetBody struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type EmailChange struct {
+	Email           string `json:"email"`
+	CurrentPassword string `json:"current_password"`
+}
+
+// normalizeEmail
+// Только сам адрес, без имени: "user@example.com".
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	parsed, err := mail.ParseAddress(email)
+	if err != nil || parsed.Address != email {
+		return ``, ErrInvalidEmail
+	}
+	return email, nil
+}
+
+func emailViolation() passwordpolicy.Violation {
+	return passwordpolicy.Violation{Field: `email`, Reason: `invalid_email`, Message: `must be a valid email address`}
+}
+
+// PasswordResetRequest
+// Письмо со ссылкой на сброс пароля. Ответ всегда 202, чтобы по нему
+// нельзя было узнать, есть ли такой логин или адрес.
+func (s *Server) PasswordResetRequest(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	contentBody, err := io.ReadAll(req.Body)
+	defer req.Body.Close()
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `inconsistent body`, http.StatusBadRequest)
+		return
+	}
+	var body PasswordResetRequestBody
+	err = json.Unmarshal(contentBody, &body)
+	if err != nil || (body.Login == `` && body.Email == ``) {
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	var login, email string
+	err = s.DB.Pool.QueryRow(
+		req.Context(),
+		`select id, login, coalesce(email, '') from public.users
+			where (login = $1 and $1 <> '') or (lower(email) = lower($2) and $2 <> '')
+			limit 1`,
+		loginpolicy.Normalize(body.Login), strings.TrimSpace(body.Email),
+	).Scan(&userID, &login, &email)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	if email != `` {
+		// событие и письмо пишутся в фоне: время ответа не зависит от наличия пользователя
+		event := newEvent(req, audit.EventPasswordResetRequest, userID, login, nil)
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.sendPasswordReset(event, email)
+		}()
+	} else {
+		s.Logger.Info(`password reset requested for unknown user or user without email`)
+	}
+
+	res.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) sendPasswordReset(event audit.Event, email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+
+	s.Events.Record(ctx, event)
+	userID, login := event.UserID, event.Login
+	token, err := s.PasswordResets.Issue(ctx, userID)
+	if err != nil {
+		if errors.Is(err, passwordreset.ErrTooFrequent) {
+			s.Logger.Warn(err.Error())
+			return
+		}
+		s.Logger.Error(err.Error())
+		return
+	}
+
+	link := token
+	if s.Config.PasswordReset.URL != `` {
+		link = s.Config.PasswordReset.URL + token
+	}
+	err = s.Mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: `Восстановление пароля`,
+		Body: `Здравствуйте, ` + login + "!\n\n" +
+			"Для вашей учётной записи запрошен сброс пароля. Чтобы задать новый пароль, используйте:\n\n" +
+			link + "\n\n" +
+			`Ссылка действует ` + s.Config.PasswordReset.TTL.String() + ` и сработает один раз. ` +
+			"Если вы не запрашивали сброс, просто проигнорируйте это письмо.\n",
+	})
+	if err != nil {
+		s.Logger.Error(`password reset mail not sent: ` + err.Error())
+	}
+}
+
+// PasswordReset
+// Новый пароль по одноразовому токену из письма
+func (s *Server) PasswordReset(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	contentBody, err := io.ReadAll(req.Body)
+	defer req.Body.Close()
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `inconsistent body`, http.StatusBadRequest)
+		return
+	}
+	var body PasswordResetBody
+	err = json.Unmarshal(contentBody, &body)
+	if err != nil || body.Token == `` {
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+
+	userID, login, err := s.PasswordResets.Lookup(req.Context(), body.Token)
+	if err != nil {
+		if errors.Is(err, passwordreset.ErrInvalidToken) {
+			s.Logger.Warn(err.Error())
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	violations := s.PasswordPolicy.Validate(`new_password`, body.NewPassword, login)
+	if len(violations) > 0 {
+		s.Logger.Warn(`password does not match policy`)
+		s.writeViolations(res, violations)
+		return
+	}
+	newHash, err := s.Passwords.Hash(body.NewPassword)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	// токен мог быть израсходован параллельным запросом, поэтому проверяется ещё раз
+	userID, err = s.PasswordResets.Reset(req.Context(), body.Token, newHash)
+	if err != nil {
+		if errors.Is(err, passwordreset.ErrInvalidToken) {
+			s.Logger.Warn(err.Error())
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	// все устройства входят заново, блокировка подбора снимается
+	err = s.Sessions.RevokeAll(req.Context(), userID, 0)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+	err = s.Lockout.Reset(req.Context(), lockout.LoginKey(login))
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+
+	s.Logger.Info(`password successfully reset`)
+	s.recordEvent(req, audit.EventPasswordReset, userID, login, nil)
+	res.WriteHeader(http.StatusOK)
+}
+
+// ChangeEmail
+// Адрес для восстановления пароля. Подтверждается текущим паролем: иначе
+// украденная сессия позволила бы перехватить аккаунт через сброс.
+func (s *Server) ChangeEmail(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+
+	contentBody, err := io.ReadAll(req.Body)
+	defer req.Body.Close()
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `inconsistent body`, http.StatusBadRequest)
+		return
+	}
+	var change EmailChange
+	err = json.Unmarshal(contentBody, &change)
+	if err != nil || change.CurrentPassword == `` {
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+	if change.Email != `` {
+		if change.Email, err = normalizeEmail(change.Email); err != nil {
+			s.writeViolations(res, []passwordpolicy.Violation{emailViolation()})
+			return
+		}
+	}
+
+	var login, pwdHash string
+	err = s.DB.Pool.QueryRow(
+		req.Context(),
+		`select login, password_hash from public.users where id = $1`,
+		userID,
+	).Scan(&login, &pwdHash)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `unauthorized`, http.StatusUnauthorized)
+		return
+	}
+	if !s.checkCurrentPassword(res, req, userID, login, pwdHash, change.CurrentPassword, audit.EventEmailChangeFailure) {
+		return
+	}
+
+	// пустой адрес отключает восстановление по почте
+	_, err = s.DB.Pool.Exec(
+		req.Context(),
+		`update public.users set email = nullif($1, '') where id = $2`,
+		change.Email, userID,
+	)
+	if err != nil {
+		var updateErr *pgconn.PgError
+		if errors.As(err, &updateErr) && updateErr.Code == `23505` {
+			http.Error(res, ErrDuplicateEmail.Error(), http.StatusConflict)
+			return
+		}
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	s.Logger.Info(`email successfully changed`)
+	s.recordEvent(req, audit.EventEmailChange, userID, login, nil)
+	res.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"go-diploma/server/cookie"
+	"go-diploma/server/session"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	accessCookie  = `token`
+	refreshCookie = `refresh_token`
+	refreshPath   = `/api/user/token`
+)
+
+// TokenResponse
+// Токены в теле ответа для клиентов, которые не работают с cookie
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// startSession
+// Открывает серверную сессию и выдаёт пользователю токены.
+func (s *Server) startSession(res http.ResponseWriter, req *http.Request, userID int) (TokenResponse, error) {
+	sess, refreshToken, err := s.Sessions.Create(req.Context(), userID, deviceFrom(req))
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return s.setAuthTokens(res, sess, refreshToken)
+}
+
+func deviceFrom(req *http.Request) session.Device {
+	return session.Device{UserAgent: req.UserAgent(), IP: clientIP(req)}
+}
+
+// setAuthTokens
+// Выставляет cookie для браузеров и возвращает те же токены для ответа в JSON.
+func (s *Server) setAuthTokens(res http.ResponseWriter, sess session.Session, refreshToken string) (TokenResponse, error) {
+	jwtString, err := s.Tokens.BuildJWTString(sess.UserID, sess.ID, sess.Role)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	csrfToken, err := cookie.NewCSRFToken()
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	http.SetCookie(res, s.Cookies.Apply(&http.Cookie{
+		Name:    accessCookie,
+		Value:   jwtString,
+		Expires: time.Now().Add(s.Tokens.TTL),
+		Path:    `/`,
+	}))
+	// refresh-токен уходит только на ручку обновления
+	http.SetCookie(res, s.Cookies.Apply(&http.Cookie{
+		Name:    refreshCookie,
+		Value:   refreshToken,
+		Expires: sess.ExpiresAt,
+		Path:    refreshPath,
+	}))
+	// новый CSRF токен на каждую пару токенов, живёт вместе с сессией
+	csrf := s.Cookies.CSRFCookieFor(csrfToken)
+	csrf.Expires = sess.ExpiresAt
+	http.SetCookie(res, csrf)
+
+	return TokenResponse{
+		AccessToken:  jwtString,
+		TokenType:    `Bearer`,
+		ExpiresIn:    int(s.Tokens.TTL.Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// wantsTokenBody
+// Клиент просит токены в теле: Accept: application/json или ?token=json.
+func wantsTokenBody(req *http.Request) bool {
+	if req.URL.Query().Get(`token`) == `json` {
+		return true
+	}
+	for _, accepted := range req.Header.Values(`Accept`) {
+		for _, part := range strings.Split(accepted, `,`) {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err == nil && mediaType == `application/json` {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// respondTokens
+// Завершает успешную аутентификацию: 200 и, если клиент просит, токены в теле.
+func (s *Server) respondTokens(res http.ResponseWriter, req *http.Request, tokens TokenResponse) {
+	if !wantsTokenBody(req) {
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+
+	marshaled, err := json.Marshal(tokens)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	res.Header().Add(`Content-Type`, `application/json`)
+	res.Header().Set(`Cache-Control`, `no-store`)
+	res.WriteHeader(http.StatusOK)
+	_, err = res.Write(marshaled)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+}
+
+func (s *Server) clearAuthCookies(res http.ResponseWriter) {
+	http.SetCookie(res, s.Cookies.Apply(&http.Cookie{Name: accessCookie, Path: `/`, MaxAge: -1}))
+	http.SetCookie(res, s.Cookies.Apply(&http.Cookie{Name: refreshCookie, Path: refreshPath, MaxAge: -1}))
+	http.SetCookie(res, &http.Cookie{Name: cookie.CSRFCookie, Path: `/`, Domain: s.Cookies.Domain, MaxAge: -1})
+}
+
+// RefreshToken
+// Обмен refresh-токена на новую пару токенов
+func (s *Server) RefreshToken(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	refreshToken := refreshFromRequest(req)
+	if refreshToken == `` {
+		http.Error(res, `unauthorized`, http.StatusUnauthorized)
+		return
+	}
+
+	sess, refreshToken, err := s.Sessions.Refresh(req.Context(), refreshToken, deviceFrom(req))
+	if err != nil {
+		if errors.Is(err, session.ErrRevoked) {
+			s.Logger.Warn(`Decline refresh token`)
+			s.clearAuthCookies(res)
+			http.Error(res, `unauthorized`, http.StatusUnauthorized)
+			return
+		}
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := s.setAuthTokens(res, sess, refreshToken)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	s.Logger.Info(`token successfully refreshed`)
+	s.respondTokens(res, req, tokens)
+}
+
+// refreshFromRequest
+// Refresh-токен приходит в JSON теле от API клиентов или в cookie от браузера.
+func refreshFromRequest(req *http.Request) string {
+	contentBody, err := io.ReadAll(req.Body)
+	defer req.Body.Close()
+	if err == nil && len(contentBody) > 0 {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if json.Unmarshal(contentBody, &body) == nil && body.RefreshToken != `` {
+			return body.RefreshToken
+		}
+	}
+	refresh, err := req.Cookie(refreshCookie)
+	if err != nil {
+		return ``
+	}
+	return refresh.Value
+}
+
+// Logout
+// Завершение текущей сессии
+func (s *Server) Logout(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+	sessionID := req.Context().Value(cookie.UserNum(`SessionID`)).(int)
+
+	err := s.Sessions.Revoke(req.Context(), sessionID, userID)
+	if err != nil && !errors.Is(err, session.ErrNotFound) {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	s.clearAuthCookies(res)
+	s.Logger.Info(`user successfully logged out`)
+	res.WriteHeader(http.StatusOK)
+}
+
+// LogoutAll
+// Завершение всех сессий пользователя на всех устройствах
+func (s *Server) LogoutAll(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+
+	err := s.Sessions.RevokeAll(req.Context(), userID, 0)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	s.clearAuthCookies(res)
+	s.Logger.Info(`all user sessions revoked`)
+	res.WriteHeader(http.StatusOK)
+}
+
+// SessionInfo
+// Сессия в списке устройств пользователя
+type SessionInfo struct {
+	session.Session
+	Current bool `json:"current"`
+}
+
+// ListSessions
+// Устройства, на которых выполнен вход
+func (s *Server) ListSessions(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+	sessionID := req.Context().Value(cookie.UserNum(`SessionID`)).(int)
+
+	sessions, err := s.Sessions.List(req.Context(), userID)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		infos = append(infos, SessionInfo{Session: sess, Current: sess.ID == sessionID})
+	}
+
+	s.writeJSON(res, http.StatusOK, infos)
+}
+
+// RevokeSession
+// Выход на одном устройстве
+func (s *Server) RevokeSession(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+	sessionID := req.Context().Value(cookie.UserNum(`SessionID`)).(int)
+
+	revokeID, err := strconv.Atoi(chi.URLParam(req, `id`))
+	if err != nil {
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return
+	}
+
+	// чужая сессия неотличима от несуществующей
+	err = s.Sessions.Revoke(req.Context(), revokeID, userID)
+	if err != nil {
+		if errors.Is(err, session.ErrNotFound) {
+			http.Error(res, `session not found`, http.StatusNotFound)
+			return
+		}
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	if revokeID == sessionID {
+		s.clearAuthCookies(res)
+	}
+	s.Logger.Info(`session revoked: ` + strconv.Itoa(revokeID))
+	res.WriteHeader(http.StatusOK)
+}
+
+// JWKS
+// Открытые ключи подписи токенов для сервисов-соседей
+func (s *Server) JWKS(res http.ResponseWriter, req *http.Request) {
+	marshaled, err := json.Marshal(s.Tokens.PublicKeys())
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Add(`Content-Type`, `application/json`)
+	res.Header().Set(`Cache-Control`, `public, max-age=300`)
+	res.WriteHeader(http.StatusOK)
+	_, err = res.Write(marshaled)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"go-diploma/server/audit"
+	"go-diploma/server/cookie"
+	"go-diploma/server/lockout"
+	"go-diploma/server/twofactor"
+	"io"
+	"net/http"
+)
+
+// headerTOTPCode свежий код для списаний выше порога.
+const headerTOTPCode = `X-TOTP-Code`
+
+// SecondFactorChallenge
+// Ответ на верный пароль, когда включён второй фактор.
+type SecondFactorChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type SecondFactorCode struct {
+	MFAToken string `json:"mfa_token,omitempty"`
+	Code     string `json:"code"`
+}
+
+// requireSecondFactor
+// 202 с токеном второго шага: сессия откроется после кода на /api/user/login/totp.
+func (s *Server) requireSecondFactor(res http.ResponseWriter, userID int) {
+	challenge, err := s.Tokens.BuildChallenge(userID)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	s.Logger.Info(`second factor required`)
+	s.writeJSON(res, http.StatusAccepted, SecondFactorChallenge{
+		MFARequired: true,
+		MFAToken:    challenge,
+		ExpiresIn:   int(cookie.ChallengeTTL.Seconds()),
+	})
+}
+
+// UserLoginTOTP
+// Второй шаг входа: код TOTP или код восстановления
+func (s *Server) UserLoginTOTP(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	code, ok := s.readSecondFactorCode(res, req)
+	if !ok {
+		return
+	}
+	challenge, err := s.Tokens.ParseChallenge(code.MFAToken)
+	if err != nil {
+		s.Logger.Warn(err.Error())
+		http.Error(res, `unauthorized`, http.StatusUnauthorized)
+		return
+	}
+	userID := challenge.UserID
+
+	login, ok := s.userLogin(res, req, userID)
+	if !ok {
+		return
+	}
+	attemptKeys := []string{lockout.LoginKey(login), lockout.IPKey(clientIP(req))}
+	if !s.verifySecondFactor(res, req, userID, code.Code, true, attemptKeys, http.StatusUnauthorized) {
+		s.recordEvent(req, audit.EventLoginFailure, userID, login, map[string]string{`reason`: `second_factor`})
+		return
+	}
+	// токен второго шага одноразовый: перехваченный вместе с кодом не откроет вторую сессию
+	err = s.TwoFactor.ConsumeChallenge(req.Context(), challenge.ID, challenge.ExpiresAt)
+	if err != nil {
+		if !errors.Is(err, twofactor.ErrChallengeUsed) {
+			s.Logger.Error(err.Error())
+			http.Error(res, `internal error`, http.StatusInternalServerError)
+			return
+		}
+		s.Logger.Warn(err.Error())
+		s.recordEvent(req, audit.EventLoginFailure, userID, login, map[string]string{`reason`: `challenge_reused`})
+		http.Error(res, `unauthorized`, http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := s.startSession(res, req, userID)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	s.Logger.Info(`user successfully authorized with second factor`)
+	s.recordEvent(req, audit.EventLoginSuccess, userID, login, map[string]string{`second_factor`: `totp`})
+	s.respondTokens(res, req, tokens)
+}
+
+// EnrollTOTP
+// Выдаёт секрет и ссылку otpauth://. Второй фактор включится после подтверждения кодом.
+func (s *Server) EnrollTOTP(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+	login, ok := s.userLogin(res, req, userID)
+	if !ok {
+		return
+	}
+
+	enrollment, err := s.TwoFactor.Enroll(req.Context(), userID, login)
+	if err != nil {
+		if errors.Is(err, twofactor.ErrAlreadyEnabled) {
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, twofactor.ErrNoEncryptionKey) {
+			http.Error(res, `two-factor authentication is unavailable`, http.StatusServiceUnavailable)
+			return
+		}
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set(`Cache-Control`, `no-store`)
+	s.writeJSON(res, http.StatusOK, enrollment)
+}
+
+// ConfirmTOTP
+// Первый верный код включает второй фактор, в ответе коды восстановления.
+func (s *Server) ConfirmTOTP(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+	code, ok := s.readSecondFactorCode(res, req)
+	if !ok {
+		return
+	}
+
+	codes, err := s.TwoFactor.Confirm(req.Context(), userID, code.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, twofactor.ErrInvalidCode):
+			http.Error(res, err.Error(), http.StatusUnprocessableEntity)
+		case errors.Is(err, twofactor.ErrNotEnrolled):
+			http.Error(res, err.Error(), http.StatusNotFound)
+		case errors.Is(err, twofactor.ErrAlreadyEnabled):
+			http.Error(res, err.Error(), http.StatusConflict)
+		default:
+			s.Logger.Error(err.Error())
+			http.Error(res, `internal error`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.Logger.Info(`second factor enabled`)
+	res.Header().Set(`Cache-Control`, `no-store`)
+	s.writeJSON(res, http.StatusOK, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{RecoveryCodes: codes})
+}
+
+// DisableTOTP
+// Выключение второго фактора по коду TOTP или коду восстановления.
+func (s *Server) DisableTOTP(res http.ResponseWriter, req *http.Request) {
+	if s.ShutdownProcess.Load() {
+		http.Error(res, "503 service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	userID := req.Context().Value(cookie.UserNum(`UserID`)).(int)
+	code, ok := s.readSecondFactorCode(res, req)
+	if !ok {
+		return
+	}
+	login, ok := s.userLogin(res, req, userID)
+	if !ok {
+		return
+	}
+	attemptKeys := []string{lockout.LoginKey(login)}
+	if !s.verifySecondFactor(res, req, userID, code.Code, true, attemptKeys, http.StatusForbidden) {
+		return
+	}
+
+	err := s.TwoFactor.Disable(req.Context(), userID)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+
+	s.Logger.Info(`second factor disabled`)
+	res.WriteHeader(http.StatusOK)
+}
+
+// checkWithdrawCode
+// Крупное списание пользователя со вторым фактором требует свежий код TOTP.
+// Возвращает false, если запрос отклонён и ответ уже отправлен.
+func (s *Server) checkWithdrawCode(res http.ResponseWriter, req *http.Request, userID int) bool {
+	enabled, err := s.TwoFactor.Enabled(req.Context(), userID)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return false
+	}
+	if !enabled {
+		return true
+	}
+
+	code := req.Header.Get(headerTOTPCode)
+	if code == `` {
+		s.Logger.Warn(`withdraw without second factor code`)
+		http.Error(res, headerTOTPCode+` header is required`, http.StatusForbidden)
+		return false
+	}
+	login, ok := s.userLogin(res, req, userID)
+	if !ok {
+		return false
+	}
+	return s.verifySecondFactor(res, req, userID, code, false, []string{lockout.LoginKey(login)}, http.StatusForbidden)
+}
+
+// verifySecondFactor
+// Проверка кода под той же защитой от перебора, что и вход.
+// Возвращает false, если код не принят и ответ уже отправлен.
+func (s *Server) verifySecondFactor(
+	res http.ResponseWriter,
+	req *http.Request,
+	userID int,
+	code string,
+	allowRecovery bool,
+	attemptKeys []string,
+	failStatus int,
+) bool {
+	wait, err := s.Lockout.Attempt(req.Context(), attemptKeys...)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return false
+	}
+	if wait > 0 {
+		s.tooManyAttempts(res, wait)
+		return false
+	}
+
+	if allowRecovery {
+		err = s.TwoFactor.VerifyOrRecover(req.Context(), userID, code)
+	} else {
+		err = s.TwoFactor.Verify(req.Context(), userID, code)
+	}
+	if err != nil {
+		if !errors.Is(err, twofactor.ErrInvalidCode) && !errors.Is(err, twofactor.ErrNotEnrolled) {
+			s.Logger.Error(err.Error())
+			http.Error(res, `internal error`, http.StatusInternalServerError)
+			return false
+		}
+		s.Logger.Warn(err.Error())
+		http.Error(res, twofactor.ErrInvalidCode.Error(), failStatus)
+		return false
+	}
+
+	err = s.Lockout.Reset(req.Context(), attemptKeys[0])
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+	err = s.Lockout.Refund(req.Context(), attemptKeys[1:]...)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+	return true
+}
+
+func (s *Server) readSecondFactorCode(res http.ResponseWriter, req *http.Request) (SecondFactorCode, bool) {
+	contentBody, err := io.ReadAll(req.Body)
+	defer req.Body.Close()
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `inconsistent body`, http.StatusBadRequest)
+		return SecondFactorCode{}, false
+	}
+	var code SecondFactorCode
+	err = json.Unmarshal(contentBody, &code)
+	if err != nil || code.Code == `` {
+		http.Error(res, `inconsistent request`, http.StatusBadRequest)
+		return SecondFactorCode{}, false
+	}
+	return code, true
+}
+
+// userLogin логин нужен для ключа блокировки и подписи в приложении-аутентификаторе.
+func (s *Server) userLogin(res http.ResponseWriter, req *http.Request, userID int) (string, bool) {
+	var login string
+	err := s.DB.Pool.QueryRow(
+		req.Context(),
+		`select login from public.users where id = $1`,
+		userID,
+	).Scan(&login)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `unauthorized`, http.StatusUnauthorized)
+		return ``, false
+	}
+	return login, true
+}
+
+func (s *Server) writeJSON(res http.ResponseWriter, status int, v any) {
+	marshaled, err := json.Marshal(v)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		http.Error(res, `internal error`, http.StatusInternalServerError)
+		return
+	}
+	res.Header().Add(`Content-Type`, `application/json`)
+	res.WriteHeader(status)
+	_, err = res.Write(marshaled)
+	if err != nil {
+		s.Logger.Error(err.Error())
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go-diploma/internal/utils/money"
+	"go-diploma/server/ledger"
+)
+
+var (
+	ErrNoBalance         = errors.New(`user has no balance yet`)
+	ErrInsufficientFunds = errors.New(`insufficient funds`)
+)
+
+// withdraw
+// Проверка баланса и списание - одна транзакция под блокировкой строки баланса:
+// параллельные списания пользователя выполняются по очереди и видят уже
+// уменьшенный баланс. CHECK в базе - последняя защита, если кто-то спишет
+// баллы в обход блокировки.
+func (s *Server) withdraw(ctx context.Context, userID int, w Withdrawal) error {
+	tx, err := s.DB.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var balance money.Amount
+	err = tx.QueryRow(
+		ctx,
+		`select current_balance from public.accruals where user_id = $1 for update`,
+		userID,
+	).Scan(&balance)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNoBalance
+		}
+		return err
+	}
+	if w.Sum > balance {
+		return ErrInsufficientFunds
+	}
+
+	var withdrawalID int
+	err = tx.QueryRow(
+		ctx,
+		`insert into public.withdrawals (user_id, sum, order_number)
+			values ($1, $2, $3)
+			returning id`,
+		userID, w.Sum, w.Order,
+	).Scan(&withdrawalID)
+	if err != nil {
+		return err
+	}
+	// баланс и сумму списаний в accruals обновляет журнал
+	_, err = ledger.Append(ctx, tx, ledger.Entry{
+		UserID:       userID,
+		Kind:         ledger.KindWithdrawal,
+		Amount:       -w.Sum,
+		WithdrawalID: &withdrawalID,
+	})
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.ConstraintName == ledger.BalanceConstraint {
+			return ErrInsufficientFunds
+		}
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,230 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	ErrNotFound = errors.New(`session not found`)
+	ErrRevoked  = errors.New(`session revoked or expired`)
+)
+
+// Session серверная сессия пользователя.
+// Access-токен несёт её ID, refresh-токен хранится только в виде хэша.
+type Session struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"-"`
+	Role       string    `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Device откуда пользователь вошёл или обновил токен.
+type Device struct {
+	UserAgent string
+	IP        string
+}
+
+// maxUserAgent длиннее заголовок не хранится.
+const maxUserAgent = 512
+
+type Store struct {
+	Pool *pgxpool.Pool
+	TTL  time.Duration
+}
+
+func (st *Store) Init(pool *pgxpool.Pool, ttl time.Duration) {
+	st.Pool = pool
+	st.TTL = ttl
+}
+
+// Create
+// Открывает сессию и возвращает refresh-токен для неё.
+func (st *Store) Create(ctx context.Context, userID int, device Device) (Session, string, error) {
+	refreshToken, refreshHash, err := newRefreshToken()
+	if err != nil {
+		return Session{}, ``, err
+	}
+
+	sess := Session{UserID: userID, UserAgent: truncate(device.UserAgent), IP: device.IP}
+	err = st.Pool.QueryRow(
+		ctx,
+		`with created as (
+				insert into public.sessions (user_id, refresh_token_hash, expires_at, user_agent, ip)
+				values ($1, $2, now() + $3::interval, $4, $5)
+				returning id, user_id, created_at, last_seen_at, expires_at
+			)
+			select created.id, users.role, created.created_at, created.last_seen_at, created.expires_at
+			from created join public.users on users.id = created.user_id`,
+		userID, refreshHash, st.TTL, sess.UserAgent, sess.IP,
+	).Scan(&sess.ID, &sess.Role, &sess.CreatedAt, &sess.LastSeenAt, &sess.ExpiresAt)
+	if err != nil {
+		return Session{}, ``, err
+	}
+
+	return sess, refreshToken, nil
+}
+
+// Refresh
+// Меняет refresh-токен на новый. Старый токен после этого недействителен.
+func (st *Store) Refresh(ctx context.Context, refreshToken string, device Device) (Session, string, error) {
+	newToken, newHash, err := newRefreshToken()
+	if err != nil {
+		return Session{}, ``, err
+	}
+
+	var sess Session
+	// роль берём из users: смена роли вступает в силу с ближайшим обновлением токена
+	err = st.Pool.QueryRow(
+		ctx,
+		`with refreshed as (
+				update public.sessions
+				set refresh_token_hash = $2,
+				    expires_at = now() + $3::interval,
+				    last_seen_at = now(),
+				    user_agent = $4,
+				    ip = $5
+				where refresh_token_hash = $1
+				  and revoked_at is null
+				  and expires_at > now()
+				returning id, user_id, user_agent, ip, created_at, last_seen_at, expires_at
+			)
+			select refreshed.id, refreshed.user_id, users.role, refreshed.user_agent, refreshed.ip,
+			       refreshed.created_at, refreshed.last_seen_at, refreshed.expires_at
+			from refreshed join public.users on users.id = refreshed.user_id`,
+		hashToken(refreshToken), newHash, st.TTL, truncate(device.UserAgent), device.IP,
+	).Scan(&sess.ID, &sess.UserID, &sess.Role, &sess.UserAgent, &sess.IP,
+		&sess.CreatedAt, &sess.LastSeenAt, &sess.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Session{}, ``, ErrRevoked
+		}
+		return Session{}, ``, err
+	}
+
+	return sess, newToken, nil
+}
+
+// Touch
+// Проверяет, что сессия принадлежит пользователю и не отозвана,
+// и отмечает время последнего запроса.
+func (st *Store) Touch(ctx context.Context, sessionID int, userID int) error {
+	var active bool
+	err := st.Pool.QueryRow(
+		ctx,
+		`update public.sessions
+			set last_seen_at = case
+				when revoked_at is null and expires_at > now() then now()
+				else last_seen_at
+			end
+			where id = $1 and user_id = $2
+			returning revoked_at is null and expires_at > now()`,
+		sessionID, userID,
+	).Scan(&active)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if !active {
+		return ErrRevoked
+	}
+	return nil
+}
+
+// List
+// Активные сессии пользователя, последние использованные первыми.
+func (st *Store) List(ctx context.Context, userID int) ([]Session, error) {
+	rows, err := st.Pool.Query(
+		ctx,
+		`select id, user_agent, ip, created_at, last_seen_at, expires_at
+			from public.sessions
+			where user_id = $1 and revoked_at is null and expires_at > now()
+			order by last_seen_at desc, id desc`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		sess := Session{UserID: userID}
+		err = rows.Scan(&sess.ID, &sess.UserAgent, &sess.IP, &sess.CreatedAt, &sess.LastSeenAt, &sess.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// Revoke
+// Отзывает одну сессию пользователя.
+func (st *Store) Revoke(ctx context.Context, sessionID int, userID int) error {
+	tag, err := st.Pool.Exec(
+		ctx,
+		`update public.sessions set revoked_at = now()
+			where id = $1 and user_id = $2 and revoked_at is null`,
+		sessionID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RevokeAll
+// Отзывает все сессии пользователя, кроме except (0 - отозвать все).
+func (st *Store) RevokeAll(ctx context.Context, userID int, except int) error {
+	_, err := st.Pool.Exec(
+		ctx,
+		`update public.sessions set revoked_at = now()
+			where user_id = $1 and id <> $2 and revoked_at is null`,
+		userID, except,
+	)
+	return err
+}
+
+func truncate(userAgent string) string {
+	if len(userAgent) <= maxUserAgent {
+		return userAgent
+	}
+	// не режем посреди многобайтного символа
+	cut := maxUserAgent
+	for cut > 0 && !utf8.RuneStart(userAgent[cut]) {
+		cut--
+	}
+	return userAgent[:cut]
+}
+
+func newRefreshToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return ``, ``, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,28 @@
+package session
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		wantLen   int
+	}{
+		{name: `Test short user agent`, userAgent: `curl/8.0`, wantLen: 8},
+		{name: `Test long user agent`, userAgent: strings.Repeat(`a`, maxUserAgent+10), wantLen: maxUserAgent},
+		{name: `Test multibyte at the edge`, userAgent: `a` + strings.Repeat(`я`, maxUserAgent), wantLen: maxUserAgent - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncate(tt.userAgent)
+			assert.Len(t, got, tt.wantLen)
+			assert.True(t, utf8.ValidString(got))
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package databasetest
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+	"go-diploma/server/storage/database"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// EnvDSN переменная с адресом тестовой базы. В CI тесты с базой обязательны.
+const EnvDSN = `TEST_DATABASE_URI`
+
+var (
+	userBase = int(time.Now().UnixNano()%1_000_000_000) + 1_000_000_000
+	userSeq  atomic.Int64
+)
+
+// New
+// База из TEST_DATABASE_URI с применёнными миграциями, закрывается по окончании теста.
+// Без базы тест пропускается, в CI - падает.
+func New(t testing.TB) *database.Database {
+	t.Helper()
+	dsn := DSN(t)
+	var db database.Database
+	require.NoError(t, db.Init(context.Background(), dsn))
+	t.Cleanup(db.Close)
+	require.NoError(t, db.PrepareDB())
+	return &db
+}
+
+// Fresh
+// Отдельная пустая база на сервере из TEST_DATABASE_URI, без миграций. Удаляется по
+// окончании теста. Для проверки миграций, которые переносят старые данные.
+func Fresh(t testing.TB) *database.Database {
+	t.Helper()
+	ctx := context.Background()
+	dsn, err := url.Parse(DSN(t))
+	require.NoError(t, err)
+	require.NotEmpty(t, dsn.Scheme, EnvDSN+` must be a URL`)
+
+	admin, err := pgx.Connect(ctx, dsn.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { admin.Close(ctx) })
+	name := fmt.Sprintf(`gophermart_test_%d`, time.Now().UnixNano())
+	_, err = admin.Exec(ctx, `create database `+name)
+	require.NoError(t, err)
+
+	dsn.Path = `/` + name
+	var db database.Database
+	require.NoError(t, db.Init(ctx, dsn.String()))
+	t.Cleanup(func() {
+		db.Close()
+		if _, err := admin.Exec(ctx, `drop database if exists `+name+` with (force)`); err != nil {
+			t.Log(err)
+		}
+	})
+	return &db
+}
+
+// DSN адрес тестовой базы, без него тест пропускается (в CI - падает).
+func DSN(t testing.TB) string {
+	t.Helper()
+	dsn := os.Getenv(EnvDSN)
+	if dsn == `` {
+		if os.Getenv(`CI`) != `` {
+			t.Fatal(EnvDSN + ` is required in CI`)
+		}
+		t.Skip(EnvDSN + ` is not set`)
+	}
+	return dsn
+}
+
+// UserID
+// Новый id пользователя, которого нет в базе. Записи журнала не удаляются, поэтому
+// у каждого теста и каждого запуска свой пользователь, за пределами id из users.
+func UserID() int {
+	return userBase + int(userSeq.Add(1))
+}
@@ -51,19 +51,18 @@ func (db *Database) Close() {
 }
 
 func (db *Database) PrepareDB() error {
-	d, err := iofs.New(migrationsDir, "migrations")
+	m, err := db.migrator()
 	if err != nil {
 		return err
 	}
-	m, err := migrate.NewWithSourceInstance(
-		`iofs`,
-		d,
-		db.DSN,
-	)
-	if err != nil {
-		return fmt.Errorf(ErrorInit.Error(), err)
-	}
+	defer m.Close()
 	err = m.Up()
+	var dirty migrate.ErrDirty
+	if errors.As(err, &dirty) {
+		// упавшую миграцию сами не повторяем: что она успела изменить, решает оператор.
+		// Например, 000010 отказывает при совпадающих логинах и перечисляет их в ошибке
+		return fmt.Errorf(`%w%v: fix the data and run "migrate force %d"`, ErrorMigrate, err, previousVersion(dirty.Version))
+	}
 	if err != nil {
 		if errors.Is(err, migrate.ErrNoChange) {
 			return nil
@@ -73,3 +72,42 @@ func (db *Database) PrepareDB() error {
 
 	return nil
 }
+
+// Migrate переводит схему на версию version. Нужна тестам миграций, которые меняют данные:
+// база готовится на старой версии и переводится на новую через PrepareDB.
+func (db *Database) Migrate(version uint) error {
+	m, err := db.migrator()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	err = m.Migrate(version)
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf(`%w%v`, ErrorMigrate, err)
+	}
+	return nil
+}
+
+func (db *Database) migrator() (*migrate.Migrate, error) {
+	d, err := iofs.New(migrationsDir, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	m, err := migrate.NewWithSourceInstance(
+		`iofs`,
+		d,
+		db.DSN,
+	)
+	if err != nil {
+		return nil, fmt.Errorf(ErrorInit.Error(), err)
+	}
+	return m, nil
+}
+
+// previousVersion версия до упавшей миграции для migrate force, -1 - ни одной миграции.
+func previousVersion(version int) int {
+	if version <= 1 {
+		return -1
+	}
+	return version - 1
+}
@@ -0,0 +1,7 @@
+BEGIN TRANSACTION;
+
+DROP INDEX IF EXISTS unique_session_refresh_token;
+DROP INDEX IF EXISTS session_user;
+DROP TABLE IF EXISTS public.sessions;
+
+COMMIT ;
\ No newline at end of file
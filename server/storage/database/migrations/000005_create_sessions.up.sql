@@ -0,0 +1,19 @@
+BEGIN TRANSACTION;
+
+CREATE TABLE IF NOT EXISTS public.sessions
+(
+    id serial PRIMARY KEY,
+    user_id int NOT NULL,
+    refresh_token_hash TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW() NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS unique_session_refresh_token
+    ON public.sessions(refresh_token_hash);
+
+CREATE INDEX IF NOT EXISTS session_user
+    ON public.sessions(user_id);
+
+COMMIT ;
\ No newline at end of file
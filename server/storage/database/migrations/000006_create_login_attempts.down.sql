@@ -0,0 +1,5 @@
+BEGIN TRANSACTION;
+
+DROP TABLE IF EXISTS public.login_attempts;
+
+COMMIT ;
\ No newline at end of file
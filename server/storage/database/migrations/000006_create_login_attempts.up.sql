@@ -0,0 +1,11 @@
+BEGIN TRANSACTION;
+
+CREATE TABLE IF NOT EXISTS public.login_attempts
+(
+    key TEXT PRIMARY KEY,
+    failures int NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP DEFAULT NOW() NOT NULL,
+    locked_until TIMESTAMP
+);
+
+COMMIT ;
\ No newline at end of file
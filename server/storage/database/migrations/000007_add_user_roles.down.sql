@@ -0,0 +1,9 @@
+BEGIN TRANSACTION;
+
+ALTER TABLE public.users
+    DROP CONSTRAINT IF EXISTS users_role_check;
+
+ALTER TABLE public.users
+    DROP COLUMN IF EXISTS role;
+
+COMMIT ;
\ No newline at end of file
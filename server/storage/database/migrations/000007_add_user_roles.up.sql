@@ -0,0 +1,12 @@
+BEGIN TRANSACTION;
+
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+
+ALTER TABLE public.users
+    DROP CONSTRAINT IF EXISTS users_role_check;
+
+ALTER TABLE public.users
+    ADD CONSTRAINT users_role_check CHECK (role IN ('user', 'operator', 'admin'));
+
+COMMIT ;
\ No newline at end of file
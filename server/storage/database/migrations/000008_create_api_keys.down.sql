@@ -0,0 +1,6 @@
+BEGIN TRANSACTION;
+
+DROP INDEX IF EXISTS unique_api_key_hash;
+DROP TABLE IF EXISTS public.api_keys;
+
+COMMIT ;
\ No newline at end of file
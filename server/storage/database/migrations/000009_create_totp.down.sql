@@ -0,0 +1,7 @@
+BEGIN TRANSACTION;
+
+DROP INDEX IF EXISTS totp_recovery_code_user;
+DROP TABLE IF EXISTS public.totp_recovery_codes;
+DROP TABLE IF EXISTS public.user_totp;
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,23 @@
+BEGIN TRANSACTION;
+
+CREATE TABLE IF NOT EXISTS public.user_totp
+(
+    user_id int PRIMARY KEY,
+    secret TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW() NOT NULL,
+    confirmed_at TIMESTAMP,
+    last_step BIGINT DEFAULT 0 NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS public.totp_recovery_codes
+(
+    id serial PRIMARY KEY,
+    user_id int NOT NULL,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS totp_recovery_code_user
+    ON public.totp_recovery_codes(user_id);
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,8 @@
+BEGIN TRANSACTION;
+
+DROP INDEX IF EXISTS unique_login;
+
+CREATE UNIQUE INDEX IF NOT EXISTS unique_login
+    ON public.users(login);
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,35 @@
+BEGIN TRANSACTION;
+
+-- логины, которые после нормализации совпадут, надо развести вручную:
+-- миграция перечисляет их и не применяется, пока они есть
+DO $$
+DECLARE
+    collisions TEXT;
+BEGIN
+    SELECT string_agg(format('%s: %s', normalized, logins), '; ')
+    INTO collisions
+    FROM (
+        SELECT lower(btrim(login)) AS normalized,
+               string_agg(format('%L (id %s)', login, id), ', ' ORDER BY id) AS logins
+        FROM public.users
+        GROUP BY lower(btrim(login))
+        HAVING count(*) > 1
+    ) AS duplicates;
+
+    IF collisions IS NOT NULL THEN
+        RAISE EXCEPTION 'login collisions after normalization: %', collisions
+            USING HINT = 'rename or merge the listed users, run "migrate force 9" and restart the service';
+    END IF;
+END
+$$;
+
+UPDATE public.users
+    SET login = lower(btrim(login))
+    WHERE login <> lower(btrim(login));
+
+DROP INDEX IF EXISTS unique_login;
+
+CREATE UNIQUE INDEX IF NOT EXISTS unique_login
+    ON public.users(lower(login));
+
+COMMIT ;
\ No newline at end of file
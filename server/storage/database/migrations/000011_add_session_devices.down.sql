@@ -0,0 +1,8 @@
+BEGIN TRANSACTION;
+
+ALTER TABLE public.sessions
+    DROP COLUMN IF EXISTS user_agent,
+    DROP COLUMN IF EXISTS ip,
+    DROP COLUMN IF EXISTS last_seen_at;
+
+COMMIT ;
\ No newline at end of file
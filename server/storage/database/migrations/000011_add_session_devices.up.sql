@@ -0,0 +1,8 @@
+BEGIN TRANSACTION;
+
+ALTER TABLE public.sessions
+    ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS ip TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP DEFAULT NOW() NOT NULL;
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,7 @@
+BEGIN TRANSACTION;
+
+DROP INDEX IF EXISTS security_event_user;
+DROP INDEX IF EXISTS security_event_created;
+DROP TABLE IF EXISTS public.security_events;
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,21 @@
+BEGIN TRANSACTION;
+
+CREATE TABLE IF NOT EXISTS public.security_events
+(
+    id bigserial PRIMARY KEY,
+    user_id int,
+    login TEXT NOT NULL DEFAULT '',
+    type TEXT NOT NULL,
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS security_event_user
+    ON public.security_events(user_id, id DESC);
+
+CREATE INDEX IF NOT EXISTS security_event_created
+    ON public.security_events(created_at);
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,11 @@
+BEGIN TRANSACTION;
+
+DROP INDEX IF EXISTS unique_password_reset_token;
+DROP INDEX IF EXISTS password_reset_user;
+DROP TABLE IF EXISTS public.password_resets;
+
+DROP INDEX IF EXISTS unique_email;
+ALTER TABLE public.users
+    DROP COLUMN IF EXISTS email;
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,26 @@
+BEGIN TRANSACTION;
+
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS email TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS unique_email
+    ON public.users(lower(email))
+    WHERE email IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS public.password_resets
+(
+    id serial PRIMARY KEY,
+    user_id int NOT NULL,
+    token_hash TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW() NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS unique_password_reset_token
+    ON public.password_resets(token_hash);
+
+CREATE INDEX IF NOT EXISTS password_reset_user
+    ON public.password_resets(user_id);
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN TRANSACTION;
+
+DROP INDEX IF EXISTS orders_user_uploaded;
+
+COMMIT ;
\ No newline at end of file
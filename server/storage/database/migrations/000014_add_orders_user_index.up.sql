@@ -0,0 +1,6 @@
+BEGIN TRANSACTION;
+
+CREATE INDEX IF NOT EXISTS orders_user_uploaded
+    ON public.orders(user_id, uploaded_at, id);
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN TRANSACTION;
+
+DROP TABLE IF EXISTS public.order_events;
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,19 @@
+BEGIN TRANSACTION;
+
+CREATE TABLE IF NOT EXISTS public.order_events
+(
+    id bigserial PRIMARY KEY,
+    order_id int NOT NULL REFERENCES public.orders(id) ON DELETE CASCADE,
+    status TEXT NOT NULL,
+    accrual float DEFAULT 0,
+    created_at TIMESTAMP DEFAULT NOW() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_events_order
+    ON public.order_events(order_id, created_at, id);
+
+-- история уже загруженных заказов начинается с текущего состояния
+INSERT INTO public.order_events (order_id, status, accrual, created_at)
+    SELECT id, status, accrual, uploaded_at FROM public.orders;
+
+COMMIT ;
\ No newline at end of file
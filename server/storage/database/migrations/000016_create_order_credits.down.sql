@@ -0,0 +1,5 @@
+BEGIN TRANSACTION;
+
+DROP TABLE IF EXISTS public.order_credits;
+
+COMMIT ;
\ No newline at end of file
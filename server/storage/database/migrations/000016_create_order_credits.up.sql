@@ -0,0 +1,18 @@
+BEGIN TRANSACTION;
+
+-- одна строка на заказ: первичный ключ не даёт начислить баллы за заказ дважды
+CREATE TABLE IF NOT EXISTS public.order_credits
+(
+    order_id int PRIMARY KEY REFERENCES public.orders(id) ON DELETE CASCADE,
+    user_id int NOT NULL,
+    amount float NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW() NOT NULL
+);
+
+-- обработанные заказы уже начислены, повторно их не начисляем
+INSERT INTO public.order_credits (order_id, user_id, amount)
+    SELECT id, user_id, accrual FROM public.orders
+    WHERE status = 'PROCESSED' AND accrual > 0
+ON CONFLICT (order_id) DO NOTHING;
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,8 @@
+BEGIN TRANSACTION;
+
+DROP TABLE IF EXISTS public.ledger_entries;
+DROP FUNCTION IF EXISTS public.ledger_apply();
+DROP FUNCTION IF EXISTS public.ledger_append_only();
+DROP INDEX IF EXISTS unique_accruals_user;
+
+COMMIT ;
\ No newline at end of file
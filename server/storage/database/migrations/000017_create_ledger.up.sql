@@ -0,0 +1,85 @@
+BEGIN TRANSACTION;
+
+-- accruals становится проекцией журнала: одна строка на пользователя
+CREATE UNIQUE INDEX IF NOT EXISTS unique_accruals_user
+    ON public.accruals(user_id);
+
+-- журнал движения баллов, только добавление. amount со знаком:
+-- начисление и отмена списания положительные, списание отрицательное
+CREATE TABLE IF NOT EXISTS public.ledger_entries
+(
+    id bigserial PRIMARY KEY,
+    user_id int NOT NULL,
+    kind TEXT NOT NULL,
+    amount float NOT NULL,
+    order_id int REFERENCES public.orders(id),
+    withdrawal_id int REFERENCES public.withdrawals(id),
+    reverses_id bigint REFERENCES public.ledger_entries(id),
+    comment TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT NOW() NOT NULL,
+    CONSTRAINT ledger_kind CHECK (kind IN ('accrual', 'withdrawal', 'adjustment', 'reversal')),
+    CONSTRAINT ledger_accrual_order CHECK (kind <> 'accrual' OR order_id IS NOT NULL),
+    CONSTRAINT ledger_withdrawal_link CHECK (kind <> 'withdrawal' OR withdrawal_id IS NOT NULL),
+    CONSTRAINT ledger_reversal_link CHECK (kind <> 'reversal' OR reverses_id IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_user
+    ON public.ledger_entries(user_id, id);
+
+-- заказ начисляется один раз, каждая запись отменяется не больше одного раза
+CREATE UNIQUE INDEX IF NOT EXISTS unique_ledger_accrual
+    ON public.ledger_entries(order_id) WHERE kind = 'accrual';
+CREATE UNIQUE INDEX IF NOT EXISTS unique_ledger_withdrawal
+    ON public.ledger_entries(withdrawal_id) WHERE kind = 'withdrawal';
+CREATE UNIQUE INDEX IF NOT EXISTS unique_ledger_reversal
+    ON public.ledger_entries(reverses_id);
+
+-- история до журнала: начисления, списания и остаток, который ими не объясняется
+INSERT INTO public.ledger_entries (user_id, kind, amount, order_id, created_at)
+    SELECT user_id, 'accrual', amount, order_id, created_at FROM public.order_credits;
+
+INSERT INTO public.ledger_entries (user_id, kind, amount, withdrawal_id, created_at)
+    SELECT user_id, 'withdrawal', -sum, id, created_at FROM public.withdrawals;
+
+INSERT INTO public.ledger_entries (user_id, kind, amount, comment)
+    SELECT accruals.user_id, 'adjustment', accruals.current_balance - coalesce(journal.balance, 0), 'opening balance'
+    FROM public.accruals
+    LEFT JOIN (
+        SELECT user_id, sum(amount) AS balance FROM public.ledger_entries GROUP BY user_id
+    ) journal ON journal.user_id = accruals.user_id
+    WHERE abs(accruals.current_balance - coalesce(journal.balance, 0)) >= 0.005;
+
+CREATE OR REPLACE FUNCTION public.ledger_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'ledger_entries is append-only, use a reversal or an adjustment';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER ledger_entries_append_only
+    BEFORE UPDATE OR DELETE ON public.ledger_entries
+    FOR EACH ROW EXECUTE FUNCTION public.ledger_append_only();
+
+-- проекция обновляется в той же транзакции, что и запись журнала
+CREATE OR REPLACE FUNCTION public.ledger_apply() RETURNS trigger AS $$
+DECLARE
+    withdrawn float := 0;
+BEGIN
+    IF NEW.kind = 'withdrawal' OR (NEW.kind = 'reversal' AND EXISTS (
+        SELECT 1 FROM public.ledger_entries WHERE id = NEW.reverses_id AND kind = 'withdrawal'
+    )) THEN
+        withdrawn := -NEW.amount;
+    END IF;
+    INSERT INTO public.accruals (user_id, current_balance, total_withdrawn)
+        VALUES (NEW.user_id, NEW.amount, withdrawn)
+    ON CONFLICT (user_id) DO UPDATE
+        SET current_balance = accruals.current_balance + EXCLUDED.current_balance,
+            total_withdrawn = accruals.total_withdrawn + EXCLUDED.total_withdrawn;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER ledger_entries_apply
+    AFTER INSERT ON public.ledger_entries
+    FOR EACH ROW EXECUTE FUNCTION public.ledger_apply();
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,30 @@
+BEGIN TRANSACTION;
+
+ALTER TABLE public.orders ALTER COLUMN accrual TYPE float;
+ALTER TABLE public.accruals
+    ALTER COLUMN current_balance TYPE float,
+    ALTER COLUMN total_withdrawn TYPE float;
+ALTER TABLE public.withdrawals ALTER COLUMN sum TYPE float;
+ALTER TABLE public.order_events ALTER COLUMN accrual TYPE float;
+ALTER TABLE public.order_credits ALTER COLUMN amount TYPE float;
+ALTER TABLE public.ledger_entries ALTER COLUMN amount TYPE float;
+
+CREATE OR REPLACE FUNCTION public.ledger_apply() RETURNS trigger AS $$
+DECLARE
+    withdrawn float := 0;
+BEGIN
+    IF NEW.kind = 'withdrawal' OR (NEW.kind = 'reversal' AND EXISTS (
+        SELECT 1 FROM public.ledger_entries WHERE id = NEW.reverses_id AND kind = 'withdrawal'
+    )) THEN
+        withdrawn := -NEW.amount;
+    END IF;
+    INSERT INTO public.accruals (user_id, current_balance, total_withdrawn)
+        VALUES (NEW.user_id, NEW.amount, withdrawn)
+    ON CONFLICT (user_id) DO UPDATE
+        SET current_balance = accruals.current_balance + EXCLUDED.current_balance,
+            total_withdrawn = accruals.total_withdrawn + EXCLUDED.total_withdrawn;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMIT ;
\ No newline at end of file
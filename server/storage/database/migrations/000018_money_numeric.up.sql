@@ -0,0 +1,63 @@
+BEGIN TRANSACTION;
+
+-- суммы в копейках без погрешности float. Значения в float уже округлены
+-- до копеек при записи, round() только убирает двоичный хвост
+ALTER TABLE public.orders
+    ALTER COLUMN accrual TYPE numeric(18,2) USING round(accrual::numeric, 2);
+ALTER TABLE public.accruals
+    ALTER COLUMN current_balance TYPE numeric(18,2) USING round(current_balance::numeric, 2),
+    ALTER COLUMN total_withdrawn TYPE numeric(18,2) USING round(total_withdrawn::numeric, 2);
+ALTER TABLE public.withdrawals
+    ALTER COLUMN sum TYPE numeric(18,2) USING round(sum::numeric, 2);
+ALTER TABLE public.order_events
+    ALTER COLUMN accrual TYPE numeric(18,2) USING round(accrual::numeric, 2);
+ALTER TABLE public.order_credits
+    ALTER COLUMN amount TYPE numeric(18,2) USING round(amount::numeric, 2);
+ALTER TABLE public.ledger_entries
+    ALTER COLUMN amount TYPE numeric(18,2) USING round(amount::numeric, 2);
+
+-- накопленная в float погрешность проекции остаётся у пользователя: баланс не меняется,
+-- разница с журналом записывается в журнал корректировкой. Проекция её уже содержит,
+-- поэтому на время вставки триггер проекции отключён
+ALTER TABLE public.ledger_entries DISABLE TRIGGER ledger_entries_apply;
+
+INSERT INTO public.ledger_entries (user_id, kind, amount, comment)
+    SELECT accruals.user_id, 'adjustment', accruals.current_balance - coalesce(journal.balance, 0),
+        'rounding difference after numeric conversion'
+    FROM public.accruals
+    LEFT JOIN (
+        SELECT user_id, sum(amount) AS balance FROM public.ledger_entries GROUP BY user_id
+    ) journal ON journal.user_id = accruals.user_id
+    WHERE accruals.current_balance <> coalesce(journal.balance, 0);
+
+ALTER TABLE public.ledger_entries ENABLE TRIGGER ledger_entries_apply;
+
+-- сумма списаний - не баланс, а итог по журналу: пересчитывается по округлённым списаниям
+UPDATE public.accruals
+    SET total_withdrawn = coalesce((
+        SELECT sum(-e.amount)
+        FROM public.ledger_entries e
+        LEFT JOIN public.ledger_entries reversed ON reversed.id = e.reverses_id
+        WHERE e.user_id = accruals.user_id
+            AND (e.kind = 'withdrawal' OR reversed.kind = 'withdrawal')
+    ), 0);
+
+CREATE OR REPLACE FUNCTION public.ledger_apply() RETURNS trigger AS $$
+DECLARE
+    withdrawn numeric(18,2) := 0;
+BEGIN
+    IF NEW.kind = 'withdrawal' OR (NEW.kind = 'reversal' AND EXISTS (
+        SELECT 1 FROM public.ledger_entries WHERE id = NEW.reverses_id AND kind = 'withdrawal'
+    )) THEN
+        withdrawn := -NEW.amount;
+    END IF;
+    INSERT INTO public.accruals (user_id, current_balance, total_withdrawn)
+        VALUES (NEW.user_id, NEW.amount, withdrawn)
+    ON CONFLICT (user_id) DO UPDATE
+        SET current_balance = accruals.current_balance + EXCLUDED.current_balance,
+            total_withdrawn = accruals.total_withdrawn + EXCLUDED.total_withdrawn;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+COMMIT ;
\ No newline at end of file
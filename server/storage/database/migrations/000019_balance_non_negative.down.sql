@@ -0,0 +1,6 @@
+BEGIN TRANSACTION;
+
+ALTER TABLE public.accruals
+    DROP CONSTRAINT IF EXISTS accruals_balance_non_negative;
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,30 @@
+BEGIN TRANSACTION;
+
+-- отрицательный баланс остался от параллельных списаний до этой миграции.
+-- Перерасход списывается корректировкой через журнал, чтобы сервис поднялся
+-- и ограничение действовало сразу; пользователи попадают в лог миграции и
+-- в журнал с комментарием, по нему их можно найти и разобрать вручную
+DO $$
+DECLARE
+    overdrawn TEXT;
+BEGIN
+    SELECT string_agg(format('user %s: %s', user_id, current_balance), ', ' ORDER BY user_id)
+    INTO overdrawn
+    FROM public.accruals
+    WHERE current_balance < 0;
+
+    IF overdrawn IS NOT NULL THEN
+        RAISE WARNING 'negative balances written off by adjustment: %', overdrawn;
+    END IF;
+END
+$$;
+
+INSERT INTO public.ledger_entries (user_id, kind, amount, comment)
+    SELECT user_id, 'adjustment', -current_balance, 'overdraft write-off before non-negative balance constraint'
+    FROM public.accruals
+    WHERE current_balance < 0;
+
+ALTER TABLE public.accruals
+    ADD CONSTRAINT accruals_balance_non_negative CHECK (current_balance >= 0);
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN TRANSACTION;
+
+DROP TABLE IF EXISTS public.idempotency_keys;
+
+COMMIT ;
\ No newline at end of file
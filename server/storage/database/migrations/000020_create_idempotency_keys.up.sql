@@ -0,0 +1,20 @@
+BEGIN TRANSACTION;
+
+CREATE TABLE IF NOT EXISTS public.idempotency_keys
+(
+    user_id int NOT NULL,
+    key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    status int,
+    content_type TEXT NOT NULL DEFAULT '',
+    body bytea,
+    created_at TIMESTAMP DEFAULT NOW() NOT NULL,
+    locked_until TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires
+    ON public.idempotency_keys(expires_at);
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,6 @@
+BEGIN TRANSACTION;
+
+DROP INDEX IF EXISTS used_login_challenges_expires;
+DROP TABLE IF EXISTS public.used_login_challenges;
+
+COMMIT ;
\ No newline at end of file
@@ -0,0 +1,13 @@
+BEGIN TRANSACTION;
+
+CREATE TABLE IF NOT EXISTS public.used_login_challenges
+(
+    id TEXT PRIMARY KEY,
+    used_at TIMESTAMP DEFAULT NOW() NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS used_login_challenges_expires
+    ON public.used_login_challenges(expires_at);
+
+COMMIT ;
\ No newline at end of file
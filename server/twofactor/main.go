@@ -0,0 +1,354 @@
+package twofactor
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go-diploma/internal/utils/totp"
+	"strings"
+	"time"
+)
+
+const recoveryCodes = 10
+
+var (
+	ErrAlreadyEnabled = errors.New(`two-factor authentication is already enabled`)
+	ErrNotEnrolled    = errors.New(`two-factor authentication is not enrolled`)
+	ErrInvalidCode    = errors.New(`invalid two-factor code`)
+	ErrChallengeUsed  = errors.New(`login challenge was already used`)
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Enrollment данные для приложения-аутентификатора.
+type Enrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// Store TOTP пользователей и их коды восстановления.
+// Код TOTP принимается один раз: last_step не даёт повторить его в том же интервале.
+// Секреты хранятся зашифрованными ключом из конфигурации, без ключа второй фактор недоступен.
+type Store struct {
+	Pool   *pgxpool.Pool
+	TOTP   totp.TOTP
+	Issuer string
+	AEAD   cipher.AEAD
+}
+
+func (st *Store) Init(pool *pgxpool.Pool, t totp.TOTP, issuer string, key []byte) error {
+	st.Pool = pool
+	st.TOTP = t
+	st.Issuer = issuer
+	st.AEAD = nil
+	if key == nil {
+		return nil
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	st.AEAD = aead
+	return nil
+}
+
+// SealPlaintext
+// Шифрует секреты, записанные до появления ключа. Вызывается при старте.
+func (st *Store) SealPlaintext(ctx context.Context) (int, error) {
+	if st.AEAD == nil {
+		return 0, ErrNoEncryptionKey
+	}
+	rows, err := st.Pool.Query(
+		ctx,
+		`select user_id, secret from public.user_totp where secret not like $1`,
+		sealedPrefix+`%`,
+	)
+	if err != nil {
+		return 0, err
+	}
+	plain := map[int]string{}
+	for rows.Next() {
+		var userID int
+		var secret string
+		if err = rows.Scan(&userID, &secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plain[userID] = secret
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sealed := 0
+	for userID, secret := range plain {
+		encrypted, err := st.seal(userID, secret)
+		if err != nil {
+			return sealed, err
+		}
+		tag, err := st.Pool.Exec(
+			ctx,
+			`update public.user_totp set secret = $3 where user_id = $1 and secret = $2`,
+			userID, secret, encrypted,
+		)
+		if err != nil {
+			return sealed, err
+		}
+		sealed += int(tag.RowsAffected())
+	}
+	return sealed, nil
+}
+
+// secret расшифрованный секрет пользователя.
+func (st *Store) secret(ctx context.Context, userID int, confirmedOnly bool) (string, bool, error) {
+	var stored string
+	var confirmed bool
+	err := st.Pool.QueryRow(
+		ctx,
+		`select secret, confirmed_at is not null from public.user_totp where user_id = $1`,
+		userID,
+	).Scan(&stored, &confirmed)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ``, false, ErrNotEnrolled
+		}
+		return ``, false, err
+	}
+	if confirmedOnly && !confirmed {
+		return ``, false, ErrNotEnrolled
+	}
+	secret, err := st.open(userID, stored)
+	if err != nil {
+		return ``, false, err
+	}
+	return secret, confirmed, nil
+}
+
+// Enroll
+// Создаёт новый секрет. До подтверждения кодом второй фактор не включён,
+// повторный вызов заменяет неподтверждённый секрет.
+func (st *Store) Enroll(ctx context.Context, userID int, login string) (Enrollment, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return Enrollment{}, err
+	}
+	sealed, err := st.seal(userID, secret)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	tag, err := st.Pool.Exec(
+		ctx,
+		`insert into public.user_totp (user_id, secret) values ($1, $2)
+			on conflict (user_id) do update
+			set secret = excluded.secret, created_at = now(), last_step = 0
+			where user_totp.confirmed_at is null`,
+		userID, sealed,
+	)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	if tag.RowsAffected() == 0 {
+		return Enrollment{}, ErrAlreadyEnabled
+	}
+	return Enrollment{
+		Secret:          secret,
+		ProvisioningURI: st.TOTP.ProvisioningURI(st.Issuer, login, secret),
+	}, nil
+}
+
+// Confirm
+// Включает второй фактор после первого верного кода и выдаёт коды восстановления.
+func (st *Store) Confirm(ctx context.Context, userID int, code string) ([]string, error) {
+	secret, confirmed, err := st.secret(ctx, userID, false)
+	if err != nil {
+		return nil, err
+	}
+	if confirmed {
+		return nil, ErrAlreadyEnabled
+	}
+	step, ok := st.TOTP.Validate(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := st.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(
+		ctx,
+		`update public.user_totp set confirmed_at = now(), last_step = $2
+			where user_id = $1 and confirmed_at is null`,
+		userID, step,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, ErrAlreadyEnabled
+	}
+	_, err = tx.Exec(ctx, `delete from public.totp_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range hashes {
+		_, err = tx.Exec(
+			ctx,
+			`insert into public.totp_recovery_codes (user_id, code_hash) values ($1, $2)`,
+			userID, hash,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Enabled включён ли у пользователя второй фактор.
+func (st *Store) Enabled(ctx context.Context, userID int) (bool, error) {
+	var enabled bool
+	err := st.Pool.QueryRow(
+		ctx,
+		`select exists(select 1 from public.user_totp where user_id = $1 and confirmed_at is not null)`,
+		userID,
+	).Scan(&enabled)
+	return enabled, err
+}
+
+// Verify
+// Проверяет свежий код TOTP. Коды восстановления не принимаются.
+func (st *Store) Verify(ctx context.Context, userID int, code string) error {
+	secret, _, err := st.secret(ctx, userID, true)
+	if err != nil {
+		return err
+	}
+	step, ok := st.TOTP.Validate(secret, code, time.Now())
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	// условие на last_step не даёт принять один код дважды, в том числе параллельно
+	tag, err := st.Pool.Exec(
+		ctx,
+		`update public.user_totp set last_step = $2 where user_id = $1 and last_step < $2`,
+		userID, step,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// VerifyOrRecover
+// Для входа: код TOTP или неиспользованный код восстановления.
+func (st *Store) VerifyOrRecover(ctx context.Context, userID int, code string) error {
+	err := st.Verify(ctx, userID, code)
+	if !errors.Is(err, ErrInvalidCode) {
+		return err
+	}
+
+	tag, err := st.Pool.Exec(
+		ctx,
+		`update public.totp_recovery_codes set used_at = now()
+			where user_id = $1 and code_hash = $2 and used_at is null`,
+		userID, hashRecoveryCode(code),
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// ConsumeChallenge
+// Отмечает токен второго шага входа использованным. Повторный вход по тому же
+// токену получает ErrChallengeUsed, даже если код ещё действует.
+func (st *Store) ConsumeChallenge(ctx context.Context, id string, expiresAt time.Time) error {
+	tag, err := st.Pool.Exec(
+		ctx,
+		`insert into public.used_login_challenges (id, expires_at) values ($1, now() + $2::interval)
+			on conflict (id) do nothing`,
+		id, time.Until(expiresAt),
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrChallengeUsed
+	}
+	return nil
+}
+
+// PurgeChallenges удаляет отметки о токенах, срок которых всё равно истёк.
+func (st *Store) PurgeChallenges(ctx context.Context) (int64, error) {
+	tag, err := st.Pool.Exec(ctx, `delete from public.used_login_challenges where expires_at <= now()`)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Disable выключает второй фактор и удаляет коды восстановления.
+func (st *Store) Disable(ctx context.Context, userID int) error {
+	tx, err := st.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `delete from public.totp_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `delete from public.user_totp where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// newRecoveryCodes коды вида xxxx-xxxx и их хэши для хранения.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodes)
+	hashes := make([]string, 0, recoveryCodes)
+	for i := 0; i < recoveryCodes; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		encoded := strings.ToLower(recoveryEncoding.EncodeToString(raw))
+		code := encoded[:4] + `-` + encoded[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode регистр и разделители при вводе не важны.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer(`-`, ``, ` `, ``).Replace(strings.TrimSpace(code)))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
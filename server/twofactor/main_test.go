@@ -0,0 +1,139 @@
+package twofactor
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-diploma/internal/utils/totp"
+	"go-diploma/server/storage/database/databasetest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = base64.StdEncoding.EncodeToString([]byte(strings.Repeat(`k`, KeySize)))
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	require.NoError(t, err)
+	require.Len(t, codes, recoveryCodes)
+	require.Len(t, hashes, recoveryCodes)
+
+	format := regexp.MustCompile(`^[a-z2-7]{4}-[a-z2-7]{4}$`)
+	seen := make(map[string]struct{}, len(codes))
+	for i, code := range codes {
+		assert.Regexp(t, format, code)
+		assert.Equal(t, hashRecoveryCode(code), hashes[i])
+		seen[code] = struct{}{}
+	}
+	assert.Len(t, seen, recoveryCodes)
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := hashRecoveryCode(`abcd-efgh`)
+
+	tests := []struct {
+		name  string
+		input string
+		same  bool
+	}{
+		{name: `Test upper case`, input: `ABCD-EFGH`, same: true},
+		{name: `Test without dash`, input: `abcdefgh`, same: true},
+		{name: `Test with spaces`, input: ` abcd efgh `, same: true},
+		{name: `Test other code`, input: `abcd-efgi`, same: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.same, hashRecoveryCode(tt.input) == want)
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+		empty   bool
+	}{
+		{name: `Test valid key`, input: testKey},
+		{name: `Test no key`, input: ``, empty: true},
+		{name: `Test short key`, input: base64.StdEncoding.EncodeToString([]byte(`short`)), wantErr: true},
+		{name: `Test not base64`, input: `not base64!`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseKey(tt.input)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrBadEncryptionKey)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.empty, key == nil)
+		})
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	key, err := ParseKey(testKey)
+	require.NoError(t, err)
+	var st Store
+	require.NoError(t, st.Init(nil, totp.New(1), `test`, key))
+
+	sealed, err := st.seal(1, `JBSWY3DPEHPK3PXP`)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealed, sealedPrefix))
+	assert.NotContains(t, sealed, `JBSWY3DPEHPK3PXP`)
+
+	secret, err := st.open(1, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, `JBSWY3DPEHPK3PXP`, secret)
+
+	// секрет чужой строки и незашифрованный секрет не принимаются
+	_, err = st.open(2, sealed)
+	assert.ErrorIs(t, err, ErrSealedSecret)
+	_, err = st.open(1, `JBSWY3DPEHPK3PXP`)
+	assert.ErrorIs(t, err, ErrSealedSecret)
+
+	var noKey Store
+	require.NoError(t, noKey.Init(nil, totp.New(1), `test`, nil))
+	_, err = noKey.seal(1, `JBSWY3DPEHPK3PXP`)
+	assert.ErrorIs(t, err, ErrNoEncryptionKey)
+}
+
+func TestStore_SecretsAndChallenges(t *testing.T) {
+	db := databasetest.New(t)
+	ctx := context.Background()
+	key, err := ParseKey(testKey)
+	require.NoError(t, err)
+	var st Store
+	require.NoError(t, st.Init(db.Pool, totp.New(1), `test`, key))
+	userID := databasetest.UserID()
+	t.Cleanup(func() {
+		st.Pool.Exec(ctx, `delete from public.user_totp where user_id = $1`, userID)
+	})
+
+	// секрет, записанный до появления ключа, шифруется при старте
+	_, err = db.Pool.Exec(ctx, `insert into public.user_totp (user_id, secret) values ($1, 'JBSWY3DPEHPK3PXP')`, userID)
+	require.NoError(t, err)
+	sealed, err := st.SealPlaintext(ctx)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, sealed, 1)
+	secret, _, err := st.secret(ctx, userID, false)
+	require.NoError(t, err)
+	assert.Equal(t, `JBSWY3DPEHPK3PXP`, secret)
+
+	enrollment, err := st.Enroll(ctx, userID, `user`)
+	require.NoError(t, err)
+	var stored string
+	require.NoError(t, db.Pool.QueryRow(ctx, `select secret from public.user_totp where user_id = $1`, userID).Scan(&stored))
+	assert.NotContains(t, stored, enrollment.Secret)
+
+	id := `challenge-` + time.Now().Format(time.RFC3339Nano)
+	require.NoError(t, st.ConsumeChallenge(ctx, id, time.Now().Add(time.Minute)))
+	assert.ErrorIs(t, st.ConsumeChallenge(ctx, id, time.Now().Add(time.Minute)), ErrChallengeUsed)
+}
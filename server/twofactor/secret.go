@@ -0,0 +1,87 @@
+package twofactor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sealedPrefix отличает зашифрованный секрет от записанного до шифрования.
+const sealedPrefix = `v1:`
+
+// KeySize длина ключа AES-256.
+const KeySize = 32
+
+var (
+	ErrNoEncryptionKey  = errors.New(`two-factor encryption key is not configured`)
+	ErrBadEncryptionKey = errors.New(`two-factor encryption key must be 32 bytes in base64`)
+	ErrSealedSecret     = errors.New(`can not decrypt two-factor secret`)
+)
+
+// ParseKey
+// Ключ шифрования секретов TOTP: 32 байта в base64. Пустая строка - ключа нет.
+func ParseKey(encoded string) ([]byte, error) {
+	if encoded == `` {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != KeySize {
+		return nil, ErrBadEncryptionKey
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrBadEncryptionKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal
+// Шифрует секрет AES-256-GCM. ID пользователя входит в проверяемые данные:
+// секрет, перенесённый в строку другого пользователя, не расшифруется.
+func (st *Store) seal(userID int, secret string) (string, error) {
+	if st.AEAD == nil {
+		return ``, ErrNoEncryptionKey
+	}
+	nonce := make([]byte, st.AEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return ``, err
+	}
+	sealed := st.AEAD.Seal(nonce, nonce, []byte(secret), secretData(userID))
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (st *Store) open(userID int, stored string) (string, error) {
+	if st.AEAD == nil {
+		return ``, ErrNoEncryptionKey
+	}
+	encoded, ok := strings.CutPrefix(stored, sealedPrefix)
+	if !ok {
+		return ``, fmt.Errorf(`user %d: secret is not encrypted: %w`, userID, ErrSealedSecret)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < st.AEAD.NonceSize() {
+		return ``, fmt.Errorf(`user %d: %w`, userID, ErrSealedSecret)
+	}
+	nonce, ciphertext := sealed[:st.AEAD.NonceSize()], sealed[st.AEAD.NonceSize():]
+	secret, err := st.AEAD.Open(nil, nonce, ciphertext, secretData(userID))
+	if err != nil {
+		return ``, fmt.Errorf(`user %d: %w`, userID, ErrSealedSecret)
+	}
+	return string(secret), nil
+}
+
+func secretData(userID int) []byte {
+	return []byte(`user_totp:` + strconv.Itoa(userID))
+}